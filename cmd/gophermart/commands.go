@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"go.uber.org/zap"
+)
+
+// subcommand is named by the first words of the arguments, the rest are its own flags and arguments.
+// run returns the exit code.
+type subcommand struct {
+	name  string
+	usage string
+	run   func(cfg *config.Config, args []string) int
+}
+
+var subcommands = []subcommand{
+	{"serve", "run HTTP and gRPC APIs with the accrual worker, it is the default", func(cfg *config.Config, _ []string) int {
+		return serve(cfg, true)
+	}},
+	{"worker", "run only the accrual worker and background jobs, APIs are not served", func(cfg *config.Config, _ []string) int {
+		return serve(cfg, false)
+	}},
+	{"migrate", "create tables and apply migrations, then exit", migrate},
+	{"config print", "print the effective config with secrets hidden", printConfig},
+	{"user create", "[-role role] [-reason text] <login>, password is read from stdin", userCreate},
+	{"user disable", "-reason text <user id>", userDisable},
+	{"user reset-password", "-reason text <user id>, password is read from stdin", userResetPassword},
+	{"ledger adjust", "-reason text <user id> <amount>, negative amount debits the balance", ledgerAdjust},
+	{"orders requeue", "-reason text <order number>, the order is checked in accrual system again", ordersRequeue},
+	{"export", "[-from time] [-to time] [-actor id] [-target t] [-action a] [-o file], audit log as NDJSON", export},
+}
+
+// command runs the subcommand named by the arguments, the config is validated for all of them but config print
+func command(cfg *config.Config, args []string) int {
+	for _, c := range subcommands {
+		words := strings.Fields(c.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != c.name {
+			continue
+		}
+		if c.name != "config print" {
+			if err := cfg.Validate(); err != nil {
+				return fail(err)
+			}
+		}
+		return c.run(cfg, args[len(words):])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(args, " "))
+	usage()
+	return 2
+}
+
+// usage lists the commands, flags of the config are listed by the flag package before it
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gophermart [flags] [command]\n\ncommands:")
+	for _, c := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %s\n    \t%s\n", c.name, c.usage)
+	}
+}
+
+func printConfig(cfg *config.Config, _ []string) int {
+	// config is printed even when it is invalid, that is when it is needed the most
+	if err := cfg.Print(os.Stdout); err != nil {
+		return fail(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func migrate(cfg *config.Config, _ []string) int {
+	return withLogger(cfg, func(ctx context.Context, logger *zap.Logger) error {
+		db, err := storage.Connect(ctx, cfg, logger)
+		if err != nil {
+			return err
+		}
+		defer db.Conn.Close()
+		if err := db.Migrate(ctx); err != nil {
+			return err
+		}
+		logger.Info("migrations are applied")
+		return nil
+	})
+}
+
+// withDB runs fn of an operations command with the db which has to be migrated already, changes made by fn
+// are audited as made by the system (actor 0) with request id "cli"
+func withDB(cfg *config.Config, fn func(ctx context.Context, db *storage.PGDB) error) int {
+	return withLogger(cfg, func(ctx context.Context, logger *zap.Logger) error {
+		db, err := storage.Connect(ctx, cfg, logger)
+		if err != nil {
+			return err
+		}
+		defer db.Conn.Close()
+		if err := db.CheckMigrations(ctx); err != nil {
+			return fmt.Errorf("%v, run gophermart migrate first", err)
+		}
+		return fn(app.WithRequestMeta(ctx, app.RequestMeta{RequestID: "cli"}), db)
+	})
+}
+
+// withLogger runs fn until it is done or interrupted, logs are written to stderr so that stdout has only the result
+func withLogger(cfg *config.Config, fn func(ctx context.Context, logger *zap.Logger) error) int {
+	logger, err := config.InitLogger(zap.NewAtomicLevelAt(cfg.Level()), cfg.AppName, cfg.LogSampling)
+	if err != nil {
+		return fail(fmt.Errorf("can't initialize zap logger: %v", err))
+	}
+	defer logger.Sync()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := fn(ctx, logger); err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
@@ -1,66 +1,31 @@
 package main
 
 import (
-	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/GoSeoTaxi/t1/internal/app"
-	"github.com/GoSeoTaxi/t1/internal/config"
-	"github.com/GoSeoTaxi/t1/internal/handlers"
-	"github.com/GoSeoTaxi/t1/internal/storage"
-	"go.uber.org/zap"
-	"log"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
-	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/config"
 )
 
 func main() {
-	fmt.Print("starting...")
-	cfg, err := config.InitConfig()
-	if err != nil {
-		log.Fatalf("can't load config: %v", err)
-	}
+	os.Exit(run(os.Args[1:]))
+}
 
-	logger, err := config.InitLogger(cfg.Debug, cfg.AppName)
-	if err != nil {
-		log.Fatalf("can't initialize zap logger: %v", err)
+// run reads the config and runs the command of the arguments, the service is served when there is no command.
+// Returned value is the exit code.
+func run(args []string) int {
+	cfg, args, err := config.Load(args)
+	if errors.Is(err, flag.ErrHelp) {
+		usage()
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "can't load config: %v\n", err)
+		return 1
 	}
-
-	logger.Info("initializing the service...")
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	// initialize db
-
-	db, err := storage.InitDB(ctx, cfg, logger)
-	if err != nil {
-		logger.Fatal("Error initializing db", zap.Error(err))
+	if len(args) == 0 {
+		args = []string{"serve"}
 	}
-
-	// prepare handles
-	r := handlers.BonusRouter(ctx, db, cfg.Key, logger)
-	srv := &http.Server{Addr: cfg.Endpoint, Handler: r}
-
-	// handle service stop
-	quit := make(chan os.Signal)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-	go func() {
-		sig := <-quit
-		logger.Info(fmt.Sprintf("caught sig: %+v", sig))
-		if err := srv.Shutdown(ctx); err != nil {
-			// Error from closing listeners, or context timeout:
-			logger.Error("HTTP server Shutdown:", zap.Error(err))
-		}
-	}()
-
-	// run update status periodically
-	statusTicker := time.NewTicker(time.Duration(1) * time.Second)
-	worker := app.NewWorker(ctx, logger, db, cfg)
-	go worker.UpdateStatus(statusTicker.C)
-
-	logger.Info("Start serving on", zap.String("endpoint name", cfg.Endpoint))
-	log.Fatal(srv.ListenAndServe())
-
+	return command(cfg, args)
 }
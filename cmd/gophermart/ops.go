@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+)
+
+// errUsage is returned when arguments of the command are wrong, usage of its flags is printed by then
+var errUsage = errors.New("wrong arguments")
+
+// parseArgs parses flags of the command and checks that n arguments are left, the reason is required when set
+func parseArgs(fs *flag.FlagSet, args []string, n int, reason *string) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() != n {
+		fmt.Fprintf(os.Stderr, "%s expects %d arguments, got %d\n", fs.Name(), n, fs.NArg())
+		return nil, errUsage
+	}
+	if reason != nil && strings.TrimSpace(*reason) == "" {
+		fmt.Fprintf(os.Stderr, "%s requires -reason, it is written to the audit log\n", fs.Name())
+		return nil, errUsage
+	}
+	return fs.Args(), nil
+}
+
+// readPassword reads the first line of stdin, so that the password is not seen in process listings and shell history
+func readPassword(in io.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("cannot read password: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password is empty")
+	}
+	return password, nil
+}
+
+func parseID(s string, what string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("wrong %s %q", what, s)
+	}
+	return id, nil
+}
+
+func userCreate(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	role := fs.String("role", models.RoleUser, "role of the user")
+	reason := fs.String("reason", "", "why the user is created, written to the audit log")
+	rest, err := parseArgs(fs, args, 1, nil)
+	if err != nil {
+		return 2
+	}
+	if !models.ValidRole(*role) {
+		return fail(fmt.Errorf("unknown role %q", *role))
+	}
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		return fail(err)
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		u := models.User{Login: rest[0], Password: models.HashPassword(password)}
+		exists, err := db.CreateNewUser(ctx, &u, app.NewAuditEvent(ctx, 0, models.AuditUserRegistered, "", *reason))
+		if exists == -1 {
+			return app.ErrLoginTaken
+		} else if err != nil {
+			return err
+		}
+		if *role != models.RoleUser {
+			ev := app.NewAuditEvent(ctx, 0, models.AuditRoleChanged, models.UserTarget(u.ID), *reason)
+			if err := db.SetUserRole(ctx, u.ID, *role, ev); err != nil {
+				return err
+			}
+		}
+
+		fmt.Println(u.ID)
+		return nil
+	})
+}
+
+func userDisable(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("user disable", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the user is blocked, written to the audit log")
+	rest, err := parseArgs(fs, args, 1, reason)
+	if err != nil {
+		return 2
+	}
+	id, err := parseID(rest[0], "user id")
+	if err != nil {
+		return fail(err)
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		return db.SetUserBlocked(ctx, id, true, app.NewAuditEvent(ctx, 0, models.AuditUserBlocked, models.UserTarget(id), *reason))
+	})
+}
+
+func userResetPassword(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the password is reset, written to the audit log")
+	rest, err := parseArgs(fs, args, 1, reason)
+	if err != nil {
+		return 2
+	}
+	id, err := parseID(rest[0], "user id")
+	if err != nil {
+		return fail(err)
+	}
+	password, err := readPassword(os.Stdin)
+	if err != nil {
+		return fail(err)
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		ev := app.NewAuditEvent(ctx, 0, models.AuditPasswordReset, models.UserTarget(id), *reason)
+		return db.SetUserPassword(ctx, id, models.HashPassword(password), ev)
+	})
+}
+
+func ledgerAdjust(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("ledger adjust", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the balance is adjusted, written to the ledger and the audit log")
+	rest, err := parseArgs(fs, args, 2, reason)
+	if err != nil {
+		return 2
+	}
+	id, err := parseID(rest[0], "user id")
+	if err != nil {
+		return fail(err)
+	}
+	// amount is in bonuses as in the API, the ledger keeps hundredths
+	amount, err := strconv.ParseFloat(rest[1], 64)
+	if err != nil || amount == 0 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return fail(fmt.Errorf("wrong amount %q", rest[1]))
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		adj := models.Adjustment{UserID: id, Amount: int64(math.Round(amount * 100)), Reason: *reason}
+		return db.AdjustBalance(ctx, adj, app.NewAuditEvent(ctx, 0, models.AuditBalanceAdjusted, models.UserTarget(id), *reason))
+	})
+}
+
+func ordersRequeue(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("orders requeue", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the order is checked again, written to the audit log")
+	rest, err := parseArgs(fs, args, 1, reason)
+	if err != nil {
+		return 2
+	}
+	valid, number, err := app.PrepOrderNumber(context.Background(), []byte(rest[0]))
+	if err != nil || !valid {
+		return fail(fmt.Errorf("wrong order number %q", rest[0]))
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		return db.RequeueOrder(ctx, number, app.NewAuditEvent(ctx, 0, models.AuditOrderRequeued, models.OrderTarget(number), *reason))
+	})
+}
+
+func export(cfg *config.Config, args []string) int {
+	var f models.AuditFilter
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := fs.String("from", "", "export events since the time, RFC3339")
+	to := fs.String("to", "", "export events before the time, RFC3339")
+	fs.Int64Var(&f.ActorID, "actor", 0, "export events made by the user id")
+	fs.StringVar(&f.Target, "target", "", "export events of the target, e.g. user:42 or order:12345678903")
+	fs.StringVar(&f.Action, "action", "", "export events of the action, e.g. balance.adjusted")
+	out := fs.String("o", "", "file to write, stdout by default")
+	if _, err := parseArgs(fs, args, 0, nil); err != nil {
+		return 2
+	}
+	for _, t := range []struct {
+		value string
+		time  *time.Time
+	}{{*from, &f.From}, {*to, &f.To}} {
+		if t.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fail(fmt.Errorf("wrong time: %v", err))
+		}
+		*t.time = parsed
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fail(err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return withDB(cfg, func(ctx context.Context, db *storage.PGDB) error {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := db.ExportAudit(ctx, f, func(ev models.AuditEvent) error {
+			return enc.Encode(&ev)
+		})
+		if err != nil {
+			return err
+		}
+		return bw.Flush()
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/events"
+	"github.com/GoSeoTaxi/t1/internal/grpcserver"
+	"github.com/GoSeoTaxi/t1/internal/handlers"
+	"github.com/GoSeoTaxi/t1/internal/metrics"
+	"github.com/GoSeoTaxi/t1/internal/outbox"
+	"github.com/GoSeoTaxi/t1/internal/ratelimit"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/GoSeoTaxi/t1/internal/throttle"
+	"github.com/GoSeoTaxi/t1/internal/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// serve runs the background jobs and, with apis, HTTP and gRPC APIs until the service is stopped.
+// Returned value is the exit code.
+func serve(cfg *config.Config, apis bool) int {
+	fmt.Print("starting...")
+
+	level := zap.NewAtomicLevelAt(cfg.Level())
+	logger, err := config.InitLogger(level, cfg.AppName, cfg.LogSampling)
+	if err != nil {
+		log.Fatalf("can't initialize zap logger: %v", err)
+	}
+
+	defer logger.Sync()
+
+	logger.Info("initializing the service...")
+	// ctx lives until the servers are drained and the worker is done, background loops stop when it is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	// loops tracks background goroutines, they are waited for before the db is closed
+	var loops sync.WaitGroup
+
+	// traces are exported in background, spans left in the buffer are flushed on shutdown
+	shutdownTracing, err := tracing.Init(ctx, cfg.Traces, cfg.TracesFile, cfg.AppName)
+	if err != nil {
+		logger.Fatal("Error initializing tracing", zap.Error(err))
+	}
+
+	// initialize db
+
+	db, err := storage.InitDB(ctx, cfg, logger)
+	if err != nil {
+		logger.Fatal("Error initializing db", zap.Error(err))
+	}
+
+	// order events are delivered both from this instance and from others through pg
+	broker := events.NewBroker()
+	db.OnOrderEvent(broker.Publish)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		db.ListenOrderEvents(ctx, broker.Publish)
+	}()
+
+	// pool is read on every scrape of /metrics, queue of orders and ledger are cached as their queries are heavy
+	prometheus.MustRegister(metrics.NewDBCollector(ctx, db, logger))
+
+	// failed logins are counted in pg so that all instances share them, memory is enough for one instance
+	var limiter *throttle.Limiter
+	switch cfg.LoginThrottle {
+	case "postgres":
+		limiter = throttle.New(throttle.NewPGStore(db.Conn), throttle.DefaultLoginPolicy, throttle.DefaultIPPolicy)
+	case "memory":
+		limiter = throttle.New(throttle.NewMemoryStore(), throttle.DefaultLoginPolicy, throttle.DefaultIPPolicy)
+	case "off":
+	default:
+		logger.Fatal("Unknown login throttle store", zap.String("store", cfg.LoginThrottle))
+	}
+
+	// API rate limits, buckets in memory are enough unless there are several instances behind a balancer
+	rateLimits, err := ratelimit.ParseLimits(cfg.RateLimits)
+	if err != nil {
+		logger.Fatal("Wrong rate limits", zap.Error(err))
+	}
+	var rateLimiter *ratelimit.Limiter
+	switch cfg.RateLimit {
+	case "postgres":
+		rateLimiter = ratelimit.New(ratelimit.NewPGStore(db.Conn), rateLimits)
+	case "memory":
+		rateLimiter = ratelimit.New(ratelimit.NewMemoryStore(), rateLimits)
+	case "off":
+	default:
+		logger.Fatal("Unknown rate limit store", zap.String("store", cfg.RateLimit))
+	}
+
+	// calls of the db from the APIs and the worker are traced, polling loops below are not to keep traces readable
+	tracedDB := storage.WithTracing(db)
+	worker := app.NewWorker(ctx, logger, tracedDB, cfg)
+
+	// instance is ready when the db is migrated and the worker keeps checking orders,
+	// accrual system is only reported unless it is required
+	checks := []handlers.Check{
+		{Name: "db", Run: db.Ping},
+		{Name: "migrations", Run: db.CheckMigrations},
+		{Name: "worker", Run: worker.Heartbeat().Check(cfg.WorkerStall)},
+		{Name: "accrual", Optional: !cfg.RequireAccrual, Run: app.AccrualCheck(cfg.AccrualSystem)},
+	}
+
+	// jwt key is shared by both APIs, it is rotated on reload together with credentials of the db,
+	// tokens of the previous key are accepted only for a grace period
+	tokenAuth := app.NewTokenAuth(cfg.Key, app.WithTokenTTL(cfg.TokenTTL), app.WithKeyGrace(cfg.KeyGrace))
+
+	// config is validated already
+	proxies, _ := cfg.TrustedProxyNets()
+
+	// metrics and probes are served on their own address which is not exposed to clients,
+	// instance without the APIs serves only them
+	servers := []*http.Server{{Addr: cfg.OpsEndpoint,
+		Handler: handlers.OpsRouter(ctx, tracedDB, logger, handlers.WithReadinessChecks(checks...), handlers.WithTrustedProxies(proxies))}}
+	if apis {
+		srv := &http.Server{Addr: cfg.Endpoint, Handler: handlers.BonusRouter(ctx, tracedDB, tokenAuth, logger,
+			handlers.WithBatchLimit(cfg.BatchLimit), handlers.WithEvents(broker), handlers.WithLoginThrottle(limiter),
+			handlers.WithRateLimit(rateLimiter), handlers.WithTrustedProxies(proxies))}
+		// event streams never become idle, they are ended as soon as shutdown starts
+		srv.RegisterOnShutdown(broker.Close)
+		servers = append(servers, srv)
+	}
+	serveErr := make(chan error, len(servers)+1)
+
+	// gRPC API on its own port
+	var grpcSrv *grpc.Server
+	if apis && cfg.GRPCEndpoint != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCEndpoint)
+		if err != nil {
+			logger.Fatal("Error listening gRPC address", zap.Error(err))
+		}
+		grpcSrv = grpcserver.NewServer(tracedDB, tokenAuth, logger, app.WithLoginThrottle(limiter))
+		go func() {
+			logger.Info("Start serving gRPC on", zap.String("endpoint name", cfg.GRPCEndpoint))
+			if err := grpcSrv.Serve(lis); err != nil {
+				serveErr <- fmt.Errorf("gRPC server failed: %w", err)
+			}
+		}()
+	}
+
+	// run update status periodically
+	statusTicker := time.NewTicker(cfg.WorkerInterval)
+	defer statusTicker.Stop()
+	workerDone := make(chan struct{})
+	go func() {
+		defer close(workerDone)
+		worker.UpdateStatus(statusTicker.C)
+	}()
+
+	// publish domain events from the outbox
+	sinks := []outbox.Sink{outbox.NewWebhookSink(db)}
+	if cfg.OutboxFile != "" {
+		fileSink, err := outbox.NewFileSink(cfg.OutboxFile)
+		if err != nil {
+			logger.Fatal("Error opening events file", zap.Error(err))
+		}
+		defer fileSink.Close()
+		sinks = append(sinks, fileSink)
+	}
+	relayTicker := time.NewTicker(time.Duration(1) * time.Second)
+	relay := outbox.NewRelay(ctx, logger, db, sinks...)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		relay.Run(relayTicker.C)
+	}()
+
+	// deliver webhooks from the outbox
+	webhookTicker := time.NewTicker(time.Duration(5) * time.Second)
+	sender := app.NewWebhookSender(ctx, logger, db)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		sender.Send(webhookTicker.C)
+	}()
+
+	// reloadable settings are applied on SIGHUP and when the config file or files of secrets change
+	reloader := config.NewReloader(cfg, os.Args[1:], logger)
+	reloader.OnReload(func(next *config.Config) {
+		level.SetLevel(next.Level())
+		worker.SetBatchSize(next.RowsToUpdate)
+		statusTicker.Reset(next.WorkerInterval)
+		if rateLimiter != nil {
+			if limits, err := ratelimit.ParseLimits(next.RateLimits); err != nil {
+				logger.Error("wrong rate limits, current ones are kept", zap.Error(err))
+			} else {
+				rateLimiter.SetLimits(limits)
+			}
+		}
+		tokenAuth.Rotate(next.Key)
+		if err := db.RotateCredentials(next.DBpath); err != nil {
+			logger.Error("rotating credentials of the db failed", zap.Error(err))
+		}
+	})
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		reloader.Run(ctx, hup, 5*time.Second)
+	}()
+
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			logger.Info("Start serving on", zap.String("endpoint name", srv.Addr))
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- fmt.Errorf("HTTP server %s failed: %w", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	code := 0
+	select {
+	case <-stopped.Done():
+		logger.Info("caught signal, shutting down", zap.Duration("timeout", cfg.ShutdownTimeout))
+	case err := <-serveErr:
+		logger.Error("server failed, shutting down", zap.Error(err))
+		code = 1
+	}
+	stop()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	// stop accepting requests and let the handlers in flight finish
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("HTTP server shutdown failed", zap.String("endpoint name", srv.Addr), zap.Error(err))
+			code = 1
+		}
+	}
+	if grpcSrv != nil {
+		drained := make(chan struct{})
+		go func() {
+			grpcSrv.GracefulStop()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-shutdownCtx.Done():
+			logger.Error("gRPC server shutdown timed out")
+			grpcSrv.Stop()
+			code = 1
+		}
+	}
+
+	// the worker saves its current batch, when time is over the batch is rolled back by canceling ctx
+	worker.Stop()
+	select {
+	case <-workerDone:
+	case <-shutdownCtx.Done():
+		logger.Error("worker did not finish its batch in time, it is rolled back")
+		code = 1
+	}
+	cancel()
+	<-workerDone
+
+	loopsDone := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-time.After(5 * time.Second):
+		logger.Error("background loops did not stop")
+		code = 1
+	}
+
+	db.Conn.Close()
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("flushing traces failed", zap.Error(err))
+	}
+	logger.Info("service stopped")
+	return code
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"context"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+)
+
+// RequestMeta tells where the request came from, it is written to audit events
+type RequestMeta struct {
+	IP        string
+	RequestID string
+}
+
+type requestMetaKey struct{}
+
+// WithRequestMeta puts meta of the request into context, APIs do it before calling the service
+func WithRequestMeta(ctx context.Context, m RequestMeta) context.Context {
+	return context.WithValue(ctx, requestMetaKey{}, m)
+}
+
+// RequestMetaFromContext gets meta of the request, it is empty when the API has not set it
+func RequestMetaFromContext(ctx context.Context) RequestMeta {
+	m, _ := ctx.Value(requestMetaKey{}).(RequestMeta)
+	return m
+}
+
+// NewAuditEvent starts audit event of the action made by the actor in the current request
+func NewAuditEvent(ctx context.Context, actor int64, action string, target string, reason string) models.AuditEvent {
+	m := RequestMetaFromContext(ctx)
+	return models.AuditEvent{
+		ActorID:   actor,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+		IP:        m.IP,
+		RequestID: m.RequestID,
+	}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+)
+
+const (
+	// DefaultPageSize is used when pagination is requested without limit
+	DefaultPageSize = 50
+	// MaxPageSize is the biggest page which can be requested
+	MaxPageSize = 500
+)
+
+var orderStatuses = map[string]bool{"NEW": true, "REGISTERED": true, "INVALID": true, "PROCESSING": true, "PROCESSED": true}
+
+var orderTypes = map[string]bool{"top_up": true, "withdraw": true}
+
+// ParseOrderFilter builds filter from the query of orders list request.
+// Second return value tells if any pagination or filter parameter was passed at all,
+// without them the whole list of uploaded orders is returned as the specification says.
+func ParseOrderFilter(q url.Values) (models.OrderFilter, bool, error) {
+	f := models.OrderFilter{Type: "top_up", Limit: DefaultPageSize}
+	paged := false
+
+	if v := q.Get("limit"); v != "" {
+		paged = true
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return f, paged, fmt.Errorf("limit should be a number from 1 to %d", MaxPageSize)
+		}
+		f.Limit = limit
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		paged = true
+		c, err := models.DecodeOrderCursor(v)
+		if err != nil {
+			return f, paged, err
+		}
+		f.After = c
+	}
+
+	if v := q.Get("status"); v != "" {
+		paged = true
+		for _, s := range strings.Split(v, ",") {
+			s = strings.ToUpper(strings.TrimSpace(s))
+			if !orderStatuses[s] {
+				return f, paged, fmt.Errorf("unknown status: %s", s)
+			}
+			f.Statuses = append(f.Statuses, s)
+		}
+	}
+
+	if v := q.Get("type"); v != "" {
+		paged = true
+		if !orderTypes[v] {
+			return f, paged, fmt.Errorf("unknown type: %s", v)
+		}
+		f.Type = v
+	}
+
+	for _, d := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(d.name)
+		if v == "" {
+			continue
+		}
+		paged = true
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, paged, fmt.Errorf("%s should be RFC3339 date: %v", d.name, err)
+		}
+		*d.dst = t
+	}
+
+	if v := q.Get("sort"); v != "" {
+		paged = true
+		switch v {
+		case "asc":
+		case "desc":
+			f.Desc = true
+		default:
+			return f, paged, fmt.Errorf("sort should be asc or desc")
+		}
+	}
+
+	return f, paged, nil
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Heartbeat is the time of the last completed round of a background loop
+type Heartbeat struct {
+	last int64
+}
+
+// Beat records that the round has completed now
+func (b *Heartbeat) Beat() {
+	atomic.StoreInt64(&b.last, time.Now().UnixNano())
+}
+
+// Check fails when there was no beat within the window, the window is counted from the creation of the check
+// at the earliest, so that the loop has time for its first round
+func (b *Heartbeat) Check(window time.Duration) func(context.Context) error {
+	started := time.Now()
+	return func(context.Context) error {
+		last := time.Unix(0, atomic.LoadInt64(&b.last))
+		if last.Before(started) {
+			last = started
+		}
+		if since := time.Since(last); since > window {
+			return fmt.Errorf("no round completed for %s", since.Round(time.Second))
+		}
+		return nil
+	}
+}
+
+// AccrualCheck checks that the accrual system answers, any response counts as it is only about reachability
+func AccrualCheck(address string) func(context.Context) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return fmt.Errorf("accrual system is not reachable: %v", err)
+		}
+		response.Body.Close()
+		return nil
+	}
+}
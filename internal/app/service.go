@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/GoSeoTaxi/t1/internal/throttle"
+	"github.com/go-chi/jwtauth/v5"
+)
+
+// Errors of user operations, each API maps them to its own status codes
+var (
+	ErrLoginTaken        = errors.New("login is already taken")
+	ErrWrongCredentials  = errors.New("login or password is wrong")
+	ErrInsufficientFunds = errors.New("current balance is not enough")
+	ErrUserBlocked       = errors.New("account is blocked")
+	ErrTooManyAttempts   = errors.New("too many failed login attempts")
+)
+
+// ThrottledError is returned by Login when the client has to wait before the next attempt
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrTooManyAttempts, e.RetryAfter)
+}
+
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrTooManyAttempts
+}
+
+// Service is the logic of user operations shared by HTTP and gRPC APIs
+type Service struct {
+	db        storage.DBinterface
+	tokenAuth *TokenAuth
+	throttle  *throttle.Limiter
+}
+
+// ServiceOption changes optional settings of the service
+type ServiceOption func(*Service)
+
+// WithLoginThrottle slows down password guessing, both APIs have to share the limiter
+func WithLoginThrottle(l *throttle.Limiter) ServiceOption {
+	return func(s *Service) {
+		s.throttle = l
+	}
+}
+
+// NewService creates service which issues tokens signed by tokenAuth
+func NewService(db storage.DBinterface, tokenAuth *TokenAuth, opts ...ServiceOption) *Service {
+	s := &Service{db: db, tokenAuth: tokenAuth}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Token issues jwt for the user, the role in claims is informational, permissions are checked with the role from the db
+func (s *Service) Token(userID int64, role string) (string, error) {
+	return s.tokenAuth.Encode(map[string]interface{}{"user_id": userID, "role": role})
+}
+
+// Authenticate verifies the token and puts it into context, so that UserIDFromContext can read it
+func (s *Service) Authenticate(ctx context.Context, token string) (context.Context, error) {
+	t, err := s.tokenAuth.Verify(token)
+	if err != nil {
+		return ctx, err
+	}
+	return jwtauth.NewContext(ctx, t, nil), nil
+}
+
+// Register creates the user and returns the token, password has to be hashed already.
+// The user and the audit event of the registration are saved together.
+func (s *Service) Register(ctx context.Context, u *models.User) (string, error) {
+	exists, err := s.db.CreateNewUser(ctx, u, NewAuditEvent(ctx, models.ActorSelf, models.AuditUserRegistered, "", ""))
+	if exists == -1 {
+		return "", ErrLoginTaken
+	} else if err != nil {
+		return "", err
+	}
+	return s.Token(u.ID, models.RoleUser)
+}
+
+// Login checks the password and returns token for the user, failed attempts are audited as well as successful ones.
+// With login throttle *ThrottledError is returned while the login or the client IP has to wait. Errors of the db
+// are not counted as failed attempts.
+func (s *Service) Login(ctx context.Context, u *models.User) (string, error) {
+	ip := RequestMetaFromContext(ctx).IP
+	if s.throttle != nil {
+		wait, err := s.throttle.Attempt(ctx, u.Login, ip)
+		if err != nil {
+			return "", err
+		} else if wait > 0 {
+			return "", &ThrottledError{RetryAfter: wait}
+		}
+	}
+
+	pass, err := s.db.SelectPass(ctx, u)
+	if errors.Is(err, storage.ErrUserNotFound) || (err == nil && !ComparePass(*pass, u.Password)) {
+		return "", s.loginFailed(ctx, u.Login, ErrWrongCredentials)
+	} else if err != nil {
+		return "", s.loginCanceled(ctx, u.Login, err)
+	}
+
+	role, blocked, err := s.db.SelectUserAccess(ctx, u.ID)
+	if err != nil {
+		return "", s.loginCanceled(ctx, u.Login, err)
+	} else if blocked {
+		return "", s.loginFailed(ctx, u.Login, ErrUserBlocked)
+	}
+
+	if s.throttle != nil {
+		if err := s.throttle.Success(ctx, u.Login, ip); err != nil {
+			return "", err
+		}
+	}
+	if err := s.db.InsertAudit(ctx, NewAuditEvent(ctx, u.ID, models.AuditLoginSucceeded, models.UserTarget(u.ID), "")); err != nil {
+		return "", err
+	}
+	return s.Token(u.ID, role)
+}
+
+// loginFailed locks the login or the IP when needed, audits the failed attempt and returns its reason
+func (s *Service) loginFailed(ctx context.Context, login string, reason error) error {
+	if s.throttle != nil {
+		locked, err := s.throttle.Failure(ctx, login, RequestMetaFromContext(ctx).IP)
+		if err != nil {
+			return err
+		}
+		if locked {
+			ev := NewAuditEvent(ctx, 0, models.AuditLoginLocked, models.LoginTarget(login), ErrTooManyAttempts.Error())
+			if err := s.db.InsertAudit(ctx, ev); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.db.InsertAudit(ctx, NewAuditEvent(ctx, 0, models.AuditLoginFailed, models.LoginTarget(login), reason.Error())); err != nil {
+		return err
+	}
+	return reason
+}
+
+// loginCanceled takes back the attempt which failed for reasons other than the password and returns err
+func (s *Service) loginCanceled(ctx context.Context, login string, err error) error {
+	if s.throttle != nil {
+		if cerr := s.throttle.Cancel(ctx, login, RequestMetaFromContext(ctx).IP); cerr != nil {
+			return fmt.Errorf("%w, canceling login attempt failed: %v", err, cerr)
+		}
+	}
+	return err
+}
+
+// UnlockLogin forgets failed attempts of the login and of the IP made by staff, empty ones are skipped
+func (s *Service) UnlockLogin(ctx context.Context, actor int64, login string, ip string, reason string) error {
+	if s.throttle != nil {
+		if err := s.throttle.Unlock(ctx, login, ip); err != nil {
+			return err
+		}
+	}
+
+	targets := []string{}
+	if login != "" {
+		targets = append(targets, models.LoginTarget(login))
+	}
+	if ip != "" {
+		targets = append(targets, models.IPTarget(ip))
+	}
+	for _, t := range targets {
+		if err := s.db.InsertAudit(ctx, NewAuditEvent(ctx, actor, models.AuditLoginUnlocked, t, reason)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadOrder saves new order of the user for accrual calculation.
+// storage.ErrOrderExists and storage.ErrOrderConflict tell who has uploaded the order before.
+func (s *Service) UploadOrder(ctx context.Context, userID int64, number int64) error {
+	return s.db.InsertOrder(ctx, models.Order{ID: number, UserID: userID, Status: "NEW", Type: "top_up"},
+		NewAuditEvent(ctx, userID, models.AuditOrderUploaded, "", ""))
+}
+
+// Withdraw pays for the order with bonuses if the balance is enough
+func (s *Service) Withdraw(ctx context.Context, userID int64, wd models.Withdrawal) error {
+	balance, err := s.db.SelectBalance(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if balance.Current < wd.Amount {
+		return ErrInsufficientFunds
+	}
+
+	// the balance is checked again under lock of the user, concurrent withdrawals may have spent it by now
+	order := models.Order{ID: wd.ID, Amount: -wd.Amount, UserID: userID, Status: "PROCESSED", Type: "withdraw"}
+	err = s.db.InsertOrder(ctx, order, NewAuditEvent(ctx, userID, models.AuditWithdrawal, "", ""))
+	if errors.Is(err, storage.ErrInsufficientFunds) {
+		return ErrInsufficientFunds
+	}
+	return err
+}
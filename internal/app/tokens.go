@@ -0,0 +1,144 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const (
+	// DefaultTokenTTL is how long issued tokens are valid
+	DefaultTokenTTL = 24 * time.Hour
+	// DefaultKeyGrace is how long tokens signed with the previous key are accepted after rotation
+	DefaultKeyGrace = 15 * time.Minute
+)
+
+// ErrTokenNotBounded is returned for tokens with no exp or iat, they could not be expired
+var ErrTokenNotBounded = errors.New("token has no exp or iat")
+
+// TokenOption changes optional settings of TokenAuth
+type TokenOption func(*TokenAuth)
+
+// WithTokenTTL sets how long issued tokens are valid
+func WithTokenTTL(ttl time.Duration) TokenOption {
+	return func(a *TokenAuth) {
+		if ttl > 0 {
+			a.ttl = ttl
+		}
+	}
+}
+
+// WithKeyGrace sets how long tokens signed with the previous key are accepted after rotation, zero turns it off
+func WithKeyGrace(grace time.Duration) TokenOption {
+	return func(a *TokenAuth) {
+		if grace >= 0 {
+			a.grace = grace
+		}
+	}
+}
+
+// TokenAuth signs and verifies jwt with the key which may be rotated while the service runs. Tokens signed
+// with the previous key stay valid for a grace period after rotation, so that users are not logged out by it,
+// while a leaked key stops working soon after it is replaced.
+type TokenAuth struct {
+	mu        sync.RWMutex
+	secret    string
+	current   *jwtauth.JWTAuth
+	previous  *jwtauth.JWTAuth
+	rotatedAt time.Time
+
+	ttl   time.Duration
+	grace time.Duration
+	now   func() time.Time
+}
+
+// NewTokenAuth makes HS256 tokens signed with the secret, HTTP and gRPC APIs have to share it
+func NewTokenAuth(secret string, opts ...TokenOption) *TokenAuth {
+	a := &TokenAuth{secret: secret, current: jwtauth.New("HS256", []byte(secret), nil),
+		ttl: DefaultTokenTTL, grace: DefaultKeyGrace, now: time.Now}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Rotate signs new tokens with the secret, it is a no-op when the secret is not changed
+func (a *TokenAuth) Rotate(secret string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if secret == a.secret {
+		return
+	}
+	a.secret = secret
+	a.previous, a.current = a.current, jwtauth.New("HS256", []byte(secret), nil)
+	a.rotatedAt = a.now()
+}
+
+// Encode issues token with the claims signed by the current key, it expires in the ttl
+func (a *TokenAuth) Encode(claims map[string]interface{}) (string, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	now := a.now()
+	bounded := make(map[string]interface{}, len(claims)+2)
+	for k, v := range claims {
+		bounded[k] = v
+	}
+	bounded[jwt.IssuedAtKey] = now.Unix()
+	bounded[jwt.ExpirationKey] = now.Add(a.ttl).Unix()
+	_, token, err := a.current.Encode(bounded)
+	return token, err
+}
+
+// Verify checks the token with the current key, then with the previous one while the grace period lasts.
+// Tokens of the previous key have to be issued before the rotation.
+func (a *TokenAuth) Verify(token string) (jwt.Token, error) {
+	a.mu.RLock()
+	current, previous, rotatedAt, grace := a.current, a.previous, a.rotatedAt, a.grace
+	a.mu.RUnlock()
+
+	now := a.now()
+	t, err := a.verify(current, token, now)
+	if err != nil && previous != nil && now.Before(rotatedAt.Add(grace)) {
+		if t, err := a.verify(previous, token, now); err == nil && !t.IssuedAt().After(rotatedAt) {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+func (a *TokenAuth) verify(ja *jwtauth.JWTAuth, token string, now time.Time) (jwt.Token, error) {
+	t, err := ja.Decode(token)
+	if err != nil {
+		return t, jwtauth.ErrorReason(err)
+	} else if t == nil {
+		return nil, jwtauth.ErrUnauthorized
+	}
+	if t.Expiration().IsZero() || t.IssuedAt().IsZero() {
+		return t, ErrTokenNotBounded
+	}
+	if err := jwt.Validate(t, jwt.WithClock(jwt.ClockFunc(func() time.Time { return now }))); err != nil {
+		return t, jwtauth.ErrorReason(err)
+	}
+	return t, nil
+}
+
+// Verifier works as jwtauth.Verifier: token from Authorization header or jwt cookie is verified and put into
+// context with the result, authenticator middleware decides what to do with it
+func (a *TokenAuth) Verifier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := jwtauth.TokenFromHeader(r)
+		if token == "" {
+			token = jwtauth.TokenFromCookie(r)
+		}
+		var t jwt.Token
+		err := jwtauth.ErrNoTokenFound
+		if token != "" {
+			t, err = a.Verify(token)
+		}
+		next.ServeHTTP(w, r.WithContext(jwtauth.NewContext(r.Context(), t, err)))
+	})
+}
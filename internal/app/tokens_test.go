@@ -0,0 +1,70 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-chi/jwtauth/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenAuth_Rotate(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	a := NewTokenAuth("first", WithKeyGrace(10*time.Minute))
+	a.now = func() time.Time { return now }
+
+	old, err := a.Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+
+	now = now.Add(time.Minute)
+	a.Rotate("second")
+	current, err := a.Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+	_, err = a.Verify(current)
+	assert.NoError(t, err)
+	_, err = a.Verify(old)
+	assert.NoError(t, err, "tokens of the previous key are valid for the grace period")
+
+	a.Rotate("second")
+	_, err = a.Verify(old)
+	assert.NoError(t, err, "rotation to the same key changes nothing")
+
+	// a leaked previous key can't issue tokens after the rotation
+	leaked := NewTokenAuth("first")
+	leaked.now = func() time.Time { return now.Add(time.Second) }
+	forged, err := leaked.Encode(map[string]interface{}{"user_id": 1})
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	_, err = a.Verify(forged)
+	assert.Error(t, err)
+
+	now = now.Add(10 * time.Minute)
+	_, err = a.Verify(old)
+	assert.Error(t, err, "the grace period is over")
+	_, err = a.Verify(current)
+	assert.NoError(t, err)
+}
+
+func TestTokenAuth_Expiry(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	a := NewTokenAuth("key", WithTokenTTL(time.Hour))
+	a.now = func() time.Time { return now }
+
+	token, err := a.Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+	parsed, err := a.Verify(token)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), parsed.Expiration())
+	assert.Equal(t, now, parsed.IssuedAt())
+
+	now = now.Add(time.Hour + time.Second)
+	_, err = a.Verify(token)
+	assert.ErrorIs(t, err, jwtauth.ErrExpired)
+
+	// tokens issued before they had exp and iat are not accepted
+	_, unbounded, err := jwtauth.New("HS256", []byte("key"), nil).Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+	_, err = a.Verify(unbounded)
+	assert.ErrorIs(t, err, ErrTokenNotBounded)
+}
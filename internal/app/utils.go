@@ -2,11 +2,15 @@ package app
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/go-chi/jwtauth/v5"
 	"github.com/theplant/luhn"
 	"strconv"
+	"strings"
 )
 
 /*
@@ -17,6 +21,15 @@ func GetBasePath() string {
 }
 */
 
+// GenerateSecret makes random hex string to be used as a secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate secret failed: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // ComparePass compares hashed passwords.
 func ComparePass(expected string, actual string) bool {
 	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
@@ -32,6 +45,37 @@ func PrepOrderNumber(ctx context.Context, n []byte) (bool, int64, error) {
 	return luhn.Valid(id), int64(id), nil
 }
 
+// SplitOrderNumbers gets order numbers from a batch which is either json array of strings or numbers
+// or plain text with a number on each line.
+func SplitOrderNumbers(contentType string, body []byte) ([]string, error) {
+	var numbers []string
+
+	switch contentType {
+	case "application/json":
+		var raw []json.RawMessage
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, fmt.Errorf("batch should be a json array: %v", err)
+		}
+		for _, r := range raw {
+			var s string
+			if err := json.Unmarshal(r, &s); err != nil {
+				s = string(r)
+			}
+			numbers = append(numbers, strings.TrimSpace(s))
+		}
+	case "text/plain":
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("batch should be application/json or text/plain")
+	}
+
+	return numbers, nil
+}
+
 // UserIDFromContext gets user if exists from context (it gets there from jwt token parsing).
 func UserIDFromContext(ctx context.Context) (int64, error) {
 	_, uID, err := jwtauth.FromContext(ctx)
@@ -45,3 +89,19 @@ func UserIDFromContext(ctx context.Context) (int64, error) {
 
 	return 0, fmt.Errorf("user_id could not be parsed a number: %v", uID["user_id"])
 }
+
+type roleKey struct{}
+
+// WithRole puts the role of the user loaded from the db into context, APIs do it after the token is verified
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// RoleFromContext gets role of the user put by WithRole. Role claim of the token is not trusted, it stays
+// in tokens of demoted users until they log in again.
+func RoleFromContext(ctx context.Context) (string, error) {
+	if role, ok := ctx.Value(roleKey{}).(string); ok {
+		return role, nil
+	}
+	return "", fmt.Errorf("role of the user is not loaded")
+}
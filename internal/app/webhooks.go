@@ -0,0 +1,222 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	// webhookBatch is how many messages are claimed from the outbox at once
+	webhookBatch = 20
+	// webhookMaxAttempts is how many times delivery is tried before the message is given up
+	webhookMaxAttempts = 8
+	// webhookFirstRetry is delay before the second attempt, every next delay is twice longer
+	webhookFirstRetry = 30 * time.Second
+	// webhookMaxRetry limits delay between attempts
+	webhookMaxRetry = time.Hour
+)
+
+// Headers of webhook requests
+const (
+	WebhookEventHeader     = "X-Gophermart-Event"
+	WebhookDeliveryHeader  = "X-Gophermart-Delivery"
+	WebhookTimestampHeader = "X-Gophermart-Timestamp"
+	WebhookSignatureHeader = "X-Gophermart-Signature"
+)
+
+// ErrWebhookAddress is returned when the webhook url leads to loopback, private, link-local or other non-public
+// address, such webhooks would let users reach the internal network and cloud metadata through the service
+var ErrWebhookAddress = errors.New("webhook url should lead to a public address")
+
+// nonPublicNets are special-purpose ranges which net.IP methods do not cover
+var nonPublicNets = []*net.IPNet{
+	mustCIDR("0.0.0.0/8"),     // this network
+	mustCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustCIDR("192.0.0.0/24"),  // IETF protocol assignments
+	mustCIDR("198.18.0.0/15"), // benchmarking
+	mustCIDR("240.0.0.0/4"),   // reserved and broadcast
+	mustCIDR("64:ff9b::/96"),  // NAT64 may lead to any IPv4 address
+}
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckWebhookURL resolves host of the webhook url, ErrWebhookAddress is returned when any of its addresses is not
+// public. The address is checked again on every delivery, as DNS may be changed after the webhook is saved.
+func CheckWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host: %w", err)
+	}
+	for _, a := range addrs {
+		if !isPublicIP(a.IP) {
+			return ErrWebhookAddress
+		}
+	}
+	return nil
+}
+
+// webhookClient delivers only to public addresses, the check is made when connection is opened, after DNS is resolved.
+// Redirects are not followed, proxies from env are not used, either of them would go around the check.
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return ErrWebhookAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+type WebhookSender struct {
+	ctx    context.Context
+	logger *zap.Logger
+	db     storage.DBinterface
+	client *http.Client
+}
+
+func NewWebhookSender(ctx context.Context, logger *zap.Logger, db storage.DBinterface) WebhookSender {
+	return WebhookSender{
+		ctx:    ctx,
+		logger: logger,
+		db:     db,
+		client: webhookClient(),
+	}
+}
+
+// SignWebhook makes signature of webhook body, receiver calculates it the same way with its copy of the secret
+// and compares it to the one in X-Gophermart-Signature header
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send acts as worker that delivers messages from the webhook outbox
+func (s *WebhookSender) Send(t <-chan time.Time) {
+	for {
+		select {
+		case <-t:
+			messages, err := s.db.ClaimWebhookMessages(s.ctx, webhookBatch)
+			if err != nil {
+				s.logger.Error("claiming webhook messages failed", zap.Error(err))
+				continue
+			}
+			for _, m := range messages {
+				s.deliver(m)
+			}
+		case <-s.ctx.Done():
+			s.logger.Info("context canceled")
+			return
+		}
+	}
+}
+
+// deliver makes one attempt to send a message and records its result
+func (s *WebhookSender) deliver(m models.WebhookMessage) {
+	d := models.WebhookDelivery{MessageID: m.ID, Event: m.Event, Attempt: m.Attempts + 1}
+	start := time.Now()
+
+	request, err := http.NewRequestWithContext(s.ctx, http.MethodPost, m.URL, bytes.NewReader(m.Payload))
+	if err == nil {
+		ts := start.Unix()
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set(WebhookEventHeader, m.Event)
+		request.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(m.ID, 10))
+		request.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+		request.Header.Set(WebhookSignatureHeader, SignWebhook(m.Secret, ts, m.Payload))
+
+		var response *http.Response
+		response, err = s.client.Do(request)
+		if err == nil {
+			response.Body.Close()
+			d.StatusCode = response.StatusCode
+		}
+	}
+	d.Duration = time.Since(start).Milliseconds()
+
+	delivered := err == nil && d.StatusCode >= 200 && d.StatusCode < 300
+	if err != nil {
+		d.Error = err.Error()
+	} else if !delivered {
+		d.Error = fmt.Sprintf("unexpected status %d", d.StatusCode)
+	}
+
+	var retryAt time.Time
+	if !delivered && d.Attempt < webhookMaxAttempts {
+		retryAt = time.Now().Add(webhookBackoff(d.Attempt))
+	}
+
+	if err := s.db.RecordWebhookDelivery(s.ctx, d, delivered, retryAt); err != nil {
+		s.logger.Error("recording webhook delivery failed", zap.Error(err), zap.Int64("message", m.ID))
+		return
+	}
+	s.logger.Debug("webhook delivery", zap.Int64("message", m.ID), zap.Int("attempt", d.Attempt), zap.Bool("delivered", delivered))
+}
+
+// webhookBackoff gives delay after the failed attempt
+func webhookBackoff(attempt int) time.Duration {
+	delay := webhookFirstRetry
+	for i := 1; i < attempt && delay < webhookMaxRetry; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetry {
+		delay = webhookMaxRetry
+	}
+	return delay
+}
@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			assert.Equal(t, tt.public, isPublicIP(net.ParseIP(tt.ip)))
+		})
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	assert.ErrorIs(t, CheckWebhookURL(context.Background(), srv.URL), ErrWebhookAddress)
+
+	// DNS may lead to the loopback after the webhook is saved, so the address is checked on connect as well
+	request, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+	require.NoError(t, err)
+	_, err = webhookClient().Do(request)
+	assert.ErrorIs(t, err, ErrWebhookAddress)
+	assert.False(t, called)
+}
@@ -5,99 +5,191 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/metrics"
 	"github.com/GoSeoTaxi/t1/internal/models"
 	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/GoSeoTaxi/t1/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Worker struct {
+	// rows is the size of the batch, it is read and set atomically and goes first to be aligned on 32-bit platforms
+	rows   int64
 	ctx    context.Context
 	logger *zap.Logger
 	db     storage.DBinterface
 	cfg    *config.Config
+	beat   *Heartbeat
+	stop   chan struct{}
+	// stopOnce is a pointer, so that copies of the worker close stop only once
+	stopOnce *sync.Once
 }
 
 func NewWorker(ctx context.Context, logger *zap.Logger, db storage.DBinterface, cfg *config.Config) Worker {
 	return Worker{
-		ctx:    ctx,
-		logger: logger,
-		db:     db,
-		cfg:    cfg,
+		rows:     cfg.RowsToUpdate,
+		ctx:      ctx,
+		logger:   logger,
+		db:       db,
+		cfg:      cfg,
+		beat:     &Heartbeat{},
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
 	}
 }
 
-// UpdateStatus acts as worker that can update status of an order
+// Heartbeat beats after every checked batch of orders, empty ones included
+func (w *Worker) Heartbeat() *Heartbeat {
+	return w.beat
+}
+
+// SetBatchSize changes how many orders are taken in the next batches
+func (w *Worker) SetBatchSize(rows int64) {
+	atomic.StoreInt64(&w.rows, rows)
+}
+
+// Stop tells UpdateStatus to return after the current batch, it does not wait for that.
+// It is safe to call Stop more than once.
+func (w *Worker) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// UpdateStatus acts as worker that can update status of an order. Batches are checked one after another,
+// it returns after Stop when the current batch is saved or when the context is canceled, in the latter case
+// the batch is rolled back and its orders are checked again by the next run.
 func (w *Worker) UpdateStatus(t <-chan time.Time) {
 
-	client := &http.Client{}
+	client := &http.Client{Transport: tracing.Transport(http.DefaultTransport)}
 	for {
 		select {
 		case <-t:
 			w.logger.Info("starting bonus update")
 			oin := make(chan []models.Order)
 			oout := make(chan models.Order)
-			go w.db.SelectOrdersForUpdate(w.ctx, w.cfg, oin, oout)
-			go w.getAccrual(oin, oout, client)
+			saved := make(chan struct{})
+			cfg := *w.cfg
+			cfg.RowsToUpdate = atomic.LoadInt64(&w.rows)
+			go func() {
+				w.db.SelectOrdersForUpdate(w.ctx, &cfg, oin, oout)
+				close(saved)
+			}()
+			w.getAccrual(oin, oout, saved, client)
+			<-saved
+		case <-w.stop:
+			w.logger.Info("worker stopped")
+			return
 		case <-w.ctx.Done():
 			w.logger.Info("context canceled")
+			return
 		}
 	}
 }
 
 // getAccrual updates statatus for each order in the selected order list, status updates are the forwarded to a channel
-// sending data furter to pg
-func (w *Worker) getAccrual(oin chan []models.Order, oout chan models.Order, client *http.Client) {
-	url := fmt.Sprintf("%s/api/orders/", w.cfg.AccrualSystem)
-	orders := <-oin
+// sending data furter to pg. Orders which the accrual system could not tell about are left for the next batch.
+// saved is closed when the storage side is done, early on error.
+func (w *Worker) getAccrual(oin chan []models.Order, oout chan models.Order, saved chan struct{}, client *http.Client) {
+	defer close(oout)
 
-	for _, order := range orders {
-		var intermOrder models.AccrualOrder
-		url += fmt.Sprint(order.ID)
-		request, err := http.NewRequest(http.MethodGet, url, nil)
+	var orders []models.Order
+	select {
+	case orders = <-oin:
+	case <-saved:
+	}
+	if len(orders) == 0 {
+		// nothing to check, idle ticks make neither spans nor batch metrics
+		w.beat.Beat()
+		return
+	}
+	start := time.Now()
+	ctx, batchSpan := tracing.Start(w.ctx, "worker.CheckOrders", trace.WithAttributes(attribute.Int("orders", len(orders))))
+	defer batchSpan.End()
 
+	for _, order := range orders {
+		orderCtx, span := tracing.Start(ctx, "worker.CheckOrder", trace.WithAttributes(tracing.OrderNumber(order.ID)))
+		accrual, err := w.checkOrder(orderCtx, client, order.ID)
+		tracing.End(span, err)
 		if err != nil {
-			w.logger.Fatal("request creation failed", zap.Error(err))
+			w.logger.Error("checking order in accrual system failed", zap.Int64("order", order.ID), zap.Error(err))
+			continue
+		} else if accrual == nil {
+			continue
 		}
 
-		response, requestErr := w.requestWithRetry(client, request)
-
-		if requestErr != nil {
-			w.logger.Error(requestErr.Error())
+		select {
+		case oout <- models.Order{ID: accrual.ID, Amount: accrual.Amount, Status: accrual.Status}:
+		case <-saved:
+			return
 		}
-		defer response.Body.Close()
+	}
 
-		decoder := json.NewDecoder(response.Body)
-		err = decoder.Decode(&intermOrder)
-		if err != nil {
-			w.logger.Debug("Error processing response" + err.Error())
-		}
+	metrics.WorkerBatchDuration.Observe(time.Since(start).Seconds())
+	metrics.WorkerBatchOrders.Add(float64(len(orders)))
+	w.beat.Beat()
+	w.logger.Info("bonus update finished")
+}
 
-		oout <- models.Order{ID: intermOrder.ID, Amount: intermOrder.Amount, Status: intermOrder.Status}
+// checkOrder asks the accrual system about the order, nil means that the order is not registered there yet
+func (w *Worker) checkOrder(ctx context.Context, client *http.Client, number int64) (*models.AccrualOrder, error) {
+	url := fmt.Sprintf("%s/api/orders/%d", w.cfg.AccrualSystem, number)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request creation failed: %v", err)
+	}
 
+	response, err := w.requestWithRetry(client, request)
+	if err != nil {
+		return nil, err
 	}
-	close(oout)
-	w.logger.Info("bonus update finished")
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var accrual models.AccrualOrder
+	if err := json.NewDecoder(response.Body).Decode(&accrual); err != nil {
+		return nil, fmt.Errorf("decoding accrual response failed: %v", err)
+	}
+	return &accrual, nil
 }
 
-// requestWithRetry sends requests several times if error or not 200 response happen
+// requestWithRetry sends requests several times if error or unexpected response happen,
+// waits between attempts end early when the context is canceled
 func (w *Worker) requestWithRetry(client *http.Client, request *http.Request) (*http.Response, error) {
-	var response *http.Response
-	var requestErr error
+	var lastErr error
 	for i := 0; i < 5; i++ {
-		response, requestErr = client.Do(request)
-		if requestErr != nil {
-			w.logger.Info("Retrying: " + requestErr.Error())
-		} else if response.StatusCode == http.StatusTooManyRequests {
-			w.logger.Info("Too many requests")
-			time.Sleep(30 * time.Second)
-		} else if response.StatusCode == http.StatusOK {
-			return response, nil
+		wait := time.Duration(i*10) * time.Second
+		response, err := client.Do(request)
+		if err != nil {
+			metrics.AccrualRequests.WithLabelValues("error").Inc()
+			lastErr = err
+			w.logger.Info("Retrying: " + err.Error())
+		} else {
+			metrics.AccrualRequests.WithLabelValues(strconv.Itoa(response.StatusCode)).Inc()
+			if response.StatusCode == http.StatusOK || response.StatusCode == http.StatusNoContent {
+				return response, nil
+			}
+			response.Body.Close()
+			lastErr = fmt.Errorf("accrual system answered %s", response.Status)
+			if response.StatusCode == http.StatusTooManyRequests {
+				w.logger.Info("Too many requests")
+				wait = 30 * time.Second
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
 		}
-		w.logger.Info("Retrying...")
-		time.Sleep(time.Duration(i*10) * time.Second)
 	}
 
-	return response, requestErr
+	return nil, lastErr
 }
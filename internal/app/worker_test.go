@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// batchDB gives the worker one batch of orders and records what comes back
+type batchDB struct {
+	storage.DBinterface
+	orders  []models.Order
+	updated chan []models.Order
+}
+
+func (db *batchDB) SelectOrdersForUpdate(ctx context.Context, cfg *config.Config, oin chan []models.Order, oout chan models.Order) {
+	oin <- db.orders
+	db.orders = nil
+
+	var updated []models.Order
+	for o := range oout {
+		updated = append(updated, o)
+	}
+	db.updated <- updated
+}
+
+func TestWorker_UpdateStatus(t *testing.T) {
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		number := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		switch number {
+		case "18":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"order": "%s", "status": "PROCESSED", "accrual": 5.5}`, number)
+		case "182":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"order": "%s", "status": "PROCESSING"}`, number)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer accrual.Close()
+
+	logger, _ := zap.NewDevelopment()
+	db := &batchDB{
+		orders:  []models.Order{{ID: 18}, {ID: 1826}, {ID: 182}},
+		updated: make(chan []models.Order, 2),
+	}
+	w := NewWorker(context.Background(), logger, db, &config.Config{AccrualSystem: accrual.URL})
+	check := w.Heartbeat().Check(time.Minute)
+
+	ticks := make(chan time.Time)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.UpdateStatus(ticks)
+	}()
+
+	ticks <- time.Now()
+	ticks <- time.Now()
+	w.Stop()
+	w.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop")
+	}
+
+	// every order of the batch is checked with its own url, the one unknown to accrual is left for later
+	require.Len(t, db.updated, 2)
+	assert.Equal(t, []models.Order{{ID: 18, Status: "PROCESSED", Amount: 550}, {ID: 182, Status: "PROCESSING"}}, <-db.updated)
+	assert.Empty(t, <-db.updated)
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestWorker_canceledBatch(t *testing.T) {
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer accrual.Close()
+
+	logger, _ := zap.NewDevelopment()
+	ctx, cancel := context.WithCancel(context.Background())
+	db := &batchDB{orders: []models.Order{{ID: 18}}, updated: make(chan []models.Order, 1)}
+	w := NewWorker(ctx, logger, db, &config.Config{AccrualSystem: accrual.URL})
+
+	ticks := make(chan time.Time, 1)
+	ticks <- time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.UpdateStatus(ticks)
+	}()
+
+	// the worker waits for the accrual system, canceling ctx ends the wait at once
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop")
+	}
+	assert.Empty(t, <-db.updated)
+}
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoad_precedence(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(yamlFile, []byte("run_address: \":7000\"\ngrpc_address: \":7100\"\nshutdown_timeout: 10s\nkey: from-file\n"), 0600))
+	tomlFile := filepath.Join(dir, "config.toml")
+	require.NoError(t, os.WriteFile(tomlFile, []byte("run_address = \":7000\"\nrows_update = 5\n"), 0600))
+
+	cfg, args, err := load([]string{"-config", yamlFile, "-a", ":7002", "config", "print"},
+		map[string]string{"RUN_ADDRESS": ":7001", "GRPC_ADDRESS": ":7101"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"config", "print"}, args)
+	assert.Equal(t, ":7002", cfg.Endpoint, "flags overwrite env")
+	assert.Equal(t, ":7101", cfg.GRPCEndpoint, "env overwrites the file")
+	assert.Equal(t, 10*time.Second, cfg.ShutdownTimeout, "the file overwrites defaults")
+	assert.Equal(t, "from-file", cfg.Key)
+	assert.Equal(t, "BonusApp", cfg.AppName, "defaults stay when nothing is set")
+
+	cfg, _, err = load(nil, map[string]string{"CONFIG_FILE": tomlFile})
+	require.NoError(t, err)
+	assert.Equal(t, ":7000", cfg.Endpoint)
+	assert.Equal(t, int64(5), cfg.RowsToUpdate)
+
+	require.NoError(t, os.WriteFile(yamlFile, []byte("run_adress: \":7000\"\n"), 0600))
+	_, _, err = load([]string{"-config", yamlFile}, nil)
+	assert.Error(t, err, "unknown keys are not ignored")
+}
+
+// mapSecrets is a provider like a vault client, it knows secrets of the map
+type mapSecrets map[string]string
+
+func (m mapSecrets) Secret(name string) (string, bool, error) {
+	v, ok := m[name]
+	return v, ok, nil
+}
+
+func TestLoad_secrets(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("key-from-file\n"), 0600))
+
+	cfg, _, err := load(nil, map[string]string{"KEY_FILE": keyFile}, mapSecrets{"KEY": "key-from-provider", "DATABASE_URI": "postgres://db/bonuses"})
+	require.NoError(t, err)
+	assert.Equal(t, "key-from-file", cfg.Key, "*_FILE goes before providers")
+	assert.Equal(t, "postgres://db/bonuses", cfg.DBpath)
+
+	cfg, _, err = load([]string{"-k", "key-from-flag"}, map[string]string{"KEY_FILE": keyFile})
+	require.NoError(t, err)
+	assert.Equal(t, "key-from-flag", cfg.Key, "flags overwrite secrets")
+
+	_, _, err = load(nil, map[string]string{"KEY_FILE": keyFile, "KEY": "key-from-env"})
+	assert.Error(t, err, "the secret is set twice")
+
+	_, _, err = load(nil, map[string]string{"KEY_FILE": filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := defaults()
+	valid.Key = "0123456789abcdef0123456789abcdef"
+	valid.DBpath = "postgres://bonuses:s3cret@db:5432/bonuses"
+
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		want   ValidationError
+	}{
+		{name: "defaults_in_development", change: func(c *Config) { *c = defaults() }},
+		{name: "production", change: func(c *Config) { c.Environment = Production }},
+		{name: "trusted_proxies", change: func(c *Config) { c.TrustedProxies = "10.0.0.0/8, 192.0.2.10,::1" }},
+		{name: "defaults_in_production",
+			change: func(c *Config) { *c = defaults(); c.Environment = Production; c.Debug = true },
+			want: ValidationError{"key is the default one, it is known to everybody",
+				"database_uri is the default one with a well known password",
+				"debug logging writes personal data, it is not allowed in production"},
+		},
+		{name: "wrong_values",
+			change: func(c *Config) {
+				c.Endpoint = "8081"
+				c.DBpath = "host=db user=bonuses"
+				c.AccrualSystem = "127.0.0.1:8080"
+				c.Key = "short"
+				c.BatchLimit = 0
+				c.LogSampling = "often"
+				c.TrustedProxies = "10.0.0.0/8, proxy"
+			},
+			want: ValidationError{`run_address "8081" is not host:port`, "database_uri is not a postgres:// URL",
+				`accrual_system_address "127.0.0.1:8080" is not a http(s):// URL`, "key is shorter than 32 bytes",
+				"orders_batch_limit has to be positive", `log_sampling: sampling "often" is not initial/thereafter`,
+				`trusted_proxies: "proxy" is neither IP nor CIDR`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.change(&c)
+			err := c.Validate()
+			if tt.want == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tt.want, err)
+		})
+	}
+}
+
+func TestConfig_redacted(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{name: "user_info", uri: "postgres://bonuses:s3cret@db:5432/bonuses?pool_max_conns=10",
+			want: "postgres://bonuses:xxxxx@db:5432/bonuses?pool_max_conns=10"},
+		{name: "query", uri: "postgresql://db/bonuses?user=bonuses&password=s3cret&sslpassword=s3cret2",
+			want: "postgresql://db/bonuses?password=%5BREDACTED%5D&sslpassword=%5BREDACTED%5D&user=bonuses"},
+		{name: "keyword_dsn", uri: "host=db user=bonuses password=s3cret", want: logging.Redacted},
+		{name: "other_scheme", uri: "mysql://bonuses:s3cret@db/bonuses?password=s3cret", want: logging.Redacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{Key: "0123456789abcdef0123456789abcdef", DBpath: tt.uri}
+			var b strings.Builder
+			require.NoError(t, c.Print(&b))
+			assert.NotContains(t, b.String(), "s3cret")
+			assert.NotContains(t, b.String(), c.Key)
+			assert.Equal(t, tt.want, c.redacted().DBpath)
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	cfg := defaults()
+	next := cfg
+	r := NewReloader(&cfg, nil, zap.New(core))
+	r.load = func() (*Config, error) {
+		c := next
+		return &c, nil
+	}
+	var applied []*Config
+	r.OnReload(func(c *Config) { applied = append(applied, c) })
+
+	require.NoError(t, r.Reload())
+	assert.Empty(t, applied, "nothing is changed")
+
+	next.RowsToUpdate = 50
+	next.Key = "rotated-key-rotated-key-rotated-key"
+	next.Endpoint = ":9000"
+	require.NoError(t, r.Reload())
+	require.Len(t, applied, 1)
+	assert.Equal(t, int64(50), applied[0].RowsToUpdate)
+	assert.Equal(t, "rotated-key-rotated-key-rotated-key", applied[0].Key)
+	assert.Equal(t, cfg.Endpoint, applied[0].Endpoint, "settings which need restart are not applied")
+
+	changed := make(map[string]map[string]interface{})
+	for _, e := range logs.AllUntimed() {
+		changed[e.ContextMap()["setting"].(string)] = e.ContextMap()
+	}
+	assert.Equal(t, "50", changed["rows_update"]["new"])
+	assert.Equal(t, "[REDACTED]", changed["key"]["new"], "secrets are not logged")
+	assert.Equal(t, "setting is changed on restart only", logs.FilterField(zap.String("setting", "run_address")).All()[0].Message)
+
+	r.load = func() (*Config, error) { return nil, assert.AnError }
+	assert.Error(t, r.Reload())
+	assert.Len(t, applied, 1)
+}
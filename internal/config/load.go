@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+)
+
+// flags overwrite fields of the config when they are set in the command line
+var flags = []struct {
+	name  string
+	field string
+	usage string
+}{
+	{"a", "Endpoint", "server address as host:port"},
+	{"ops", "OpsEndpoint", "metrics and probes address as host:port, it is not meant for clients"},
+	{"g", "GRPCEndpoint", "gRPC server address as host:port, empty to turn it off"},
+	{"d", "DBpath", "postgres connection URI"},
+	{"debug", "Debug", "log at debug level"},
+	{"r", "AccrualSystem", "accrual system address as http://host:port"},
+	{"k", "Key", "key which signs jwt, at least 32 bytes"},
+}
+
+// Load reads the config file set by -config flag or CONFIG_FILE, then env with secrets, then flags. Secrets are
+// read from files of *_FILE variables, then from providers. Arguments left after flags are returned, they name
+// a command run instead of the service. The config is not validated.
+func Load(args []string, providers ...SecretProvider) (*Config, []string, error) {
+	return load(args, environ(), providers...)
+}
+
+func load(args []string, environ map[string]string, providers ...SecretProvider) (*Config, []string, error) {
+	cfg := defaults()
+
+	fromFlags := cfg
+	fs := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	file := fs.String("config", environ["CONFIG_FILE"], "config file, YAML or TOML by extension")
+	for _, f := range flags {
+		switch p := reflect.ValueOf(&fromFlags).Elem().FieldByName(f.field).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(p, f.name, *p, f.usage)
+		case *bool:
+			fs.BoolVar(p, f.name, *p, f.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *file != "" {
+		if err := readFile(&cfg, *file); err != nil {
+			return nil, nil, err
+		}
+		cfg.File = *file
+	}
+
+	var fromEnv Config
+	if err := env.Parse(&fromEnv, env.Options{Environment: environ}); err != nil {
+		return nil, nil, err
+	}
+	dst, src := reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(fromEnv)
+	for i := 0; i < dst.NumField(); i++ {
+		if _, ok := environ[dst.Type().Field(i).Tag.Get("env")]; ok {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+
+	providers = append([]SecretProvider{FileSecrets(environ)}, providers...)
+	for _, sec := range secrets {
+		for _, p := range providers {
+			v, ok, err := p.Secret(sec.name)
+			if err != nil {
+				return nil, nil, err
+			} else if !ok {
+				continue
+			}
+			if _, inEnv := environ[sec.name]; inEnv {
+				return nil, nil, fmt.Errorf("%s is set both in env and as a secret", sec.name)
+			}
+			dst.FieldByName(sec.field).SetString(v)
+			break
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range flags {
+			if f.name == fl.Name {
+				dst.FieldByName(f.field).Set(reflect.ValueOf(fromFlags).FieldByName(f.field))
+			}
+		}
+	})
+
+	return &cfg, fs.Args(), nil
+}
+
+// defaults are values of envDefault tags
+func defaults() Config {
+	var cfg Config
+	// there are no required fields, so parsing of an empty environment does not fail
+	env.Parse(&cfg, env.Options{Environment: map[string]string{}})
+	return cfg
+}
+
+// readFile fills fields present in the file, unknown keys are errors so that typos do not go unnoticed
+func readFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("cannot parse config file %s: %v", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("cannot parse config file %s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown keys in config file %s: %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config file %s is neither .yaml nor .toml", path)
+	}
+	return nil
+}
+
+func environ() map[string]string {
+	m := make(map[string]string)
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			m[parts[0]] = parts[1]
+		}
+	}
+	return m
+}
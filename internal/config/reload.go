@@ -0,0 +1,163 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Change is a setting which differs in the reloaded config, values of secrets are hidden
+type Change struct {
+	Setting string
+	Old     string
+	New     string
+	// Reloadable changes are applied at once, others on restart
+	Reloadable bool
+}
+
+// Diff lists settings which differ in the configs, settings are named as keys of the config file
+func Diff(old *Config, next *Config) []Change {
+	o, n := reflect.ValueOf(*old), reflect.ValueOf(*next)
+	shownOld, shownNext := reflect.ValueOf(old.redacted()), reflect.ValueOf(next.redacted())
+
+	var changes []Change
+	for i := 0; i < o.NumField(); i++ {
+		f := o.Type().Field(i)
+		if f.Tag.Get("yaml") == "-" || reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			continue
+		}
+		changes = append(changes, Change{
+			Setting:    f.Tag.Get("yaml"),
+			Old:        fmt.Sprint(shownOld.Field(i).Interface()),
+			New:        fmt.Sprint(shownNext.Field(i).Interface()),
+			Reloadable: f.Tag.Get("reload") == "true",
+		})
+	}
+	return changes
+}
+
+// Reloader reads the config again on SIGHUP and when the config file or files of secrets change. Changed settings
+// are logged and the config with reloadable ones applied is passed to subscribers. Invalid config is reported
+// and the current one is kept.
+type Reloader struct {
+	load   func() (*Config, error)
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	current *Config
+	subs    []func(*Config)
+}
+
+// NewReloader reloads cfg read from args and providers
+func NewReloader(cfg *Config, args []string, logger *zap.Logger, providers ...SecretProvider) *Reloader {
+	return &Reloader{
+		load: func() (*Config, error) {
+			next, _, err := Load(args, providers...)
+			if err != nil {
+				return nil, err
+			}
+			return next, next.Validate()
+		},
+		logger:  logger,
+		current: cfg,
+	}
+}
+
+// OnReload adds fn called with the config every time reloadable settings change, fn has to apply them
+func (r *Reloader) OnReload(fn func(cfg *Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs = append(r.subs, fn)
+}
+
+// Reload reads the config and applies its reloadable settings
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	applied := *r.current
+	a, n := reflect.ValueOf(&applied).Elem(), reflect.ValueOf(*next)
+	reloaded := false
+	for _, c := range Diff(r.current, next) {
+		if !c.Reloadable {
+			r.logger.Warn("setting is changed on restart only", zap.String("setting", c.Setting),
+				zap.String("old", c.Old), zap.String("new", c.New))
+			continue
+		}
+		r.logger.Info("setting changed", zap.String("setting", c.Setting), zap.String("old", c.Old), zap.String("new", c.New))
+		reloaded = true
+	}
+	if !reloaded {
+		return nil
+	}
+
+	for i := 0; i < a.NumField(); i++ {
+		if a.Type().Field(i).Tag.Get("reload") == "true" {
+			a.Field(i).Set(n.Field(i))
+		}
+	}
+	r.current = &applied
+	for _, fn := range r.subs {
+		fn(&applied)
+	}
+	return nil
+}
+
+// Run reloads the config on every signal of hup and when modification time of the config file or files of secrets
+// changes, they are checked every poll. It returns when ctx is canceled.
+func (r *Reloader) Run(ctx context.Context, hup <-chan os.Signal, poll time.Duration) {
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	modified := r.modified()
+	for {
+		select {
+		case <-hup:
+			r.logger.Info("reloading config on signal")
+		case <-ticker.C:
+			m := r.modified()
+			if m == modified {
+				continue
+			}
+			modified = m
+			r.logger.Info("reloading changed config")
+		case <-ctx.Done():
+			return
+		}
+		if err := r.Reload(); err != nil {
+			r.logger.Error("reloading config failed, current one is kept", zap.Error(err))
+		}
+	}
+}
+
+// modified sums up modification times of the watched files, missing files are skipped
+func (r *Reloader) modified() string {
+	r.mu.Lock()
+	files := []string{r.current.File}
+	r.mu.Unlock()
+	env := environ()
+	for _, s := range secrets {
+		files = append(files, env[s.name+"_FILE"])
+	}
+
+	var stamp string
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			stamp += f + "@" + info.ModTime().String() + ";"
+		}
+	}
+	return stamp
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SecretProvider gives secrets by the name of their env variable, ok is false when the provider does not know it
+type SecretProvider interface {
+	Secret(name string) (value string, ok bool, err error)
+}
+
+// secrets are fields which may be kept out of env and flags, so that they are not seen in process listings
+var secrets = []struct {
+	name  string
+	field string
+}{
+	{"KEY", "Key"},
+	{"DATABASE_URI", "DBpath"},
+}
+
+// FileSecrets reads the secret from the file named by NAME_FILE variable, e.g. KEY_FILE, the way docker
+// and kubernetes mount secrets. Trailing newline of the file is not a part of the secret.
+type FileSecrets map[string]string
+
+func (e FileSecrets) Secret(name string) (string, bool, error) {
+	path, ok := e[name+"_FILE"]
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read %s_FILE: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/GoSeoTaxi/t1/internal/logging"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Development allows the defaults, so that the service starts with no config at all
+	Development = "development"
+	// Production refuses to start with defaults which are fine only on a laptop
+	Production = "production"
+)
+
+// minKeyLength is the size of SHA-256 output, shorter HS256 keys are easier to brute force
+const minKeyLength = 32
+
+// ValidationError lists every problem of the config, so that all of them are fixed at once
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// Validate checks the config before the service starts
+func (c *Config) Validate() error {
+	var errs ValidationError
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+
+	check(oneOf(c.Environment, Development, Production), "app_env %q is neither %s nor %s", c.Environment, Development, Production)
+	check(isHostPort(c.Endpoint), "run_address %q is not host:port", c.Endpoint)
+	check(isHostPort(c.OpsEndpoint), "ops_address %q is not host:port", c.OpsEndpoint)
+	check(c.GRPCEndpoint == "" || isHostPort(c.GRPCEndpoint), "grpc_address %q is not host:port", c.GRPCEndpoint)
+	// the uri has a password, so it is not put into the error
+	check(isURL(c.DBpath, "postgres", "postgresql"), "database_uri is not a postgres:// URL")
+	check(isURL(c.AccrualSystem, "http", "https"), "accrual_system_address %q is not a http(s):// URL", c.AccrualSystem)
+	check(len(c.Key) >= minKeyLength, "key is shorter than %d bytes", minKeyLength)
+	check(c.TokenTTL > 0, "token_ttl has to be positive")
+	check(c.KeyGrace >= 0, "key_rotation_grace should not be negative")
+	check(c.RowsToUpdate > 0, "rows_update has to be positive")
+	check(c.BatchLimit > 0, "orders_batch_limit has to be positive")
+	check(c.WorkerInterval > 0, "worker_interval has to be positive")
+	check(c.WorkerStall > 0, "worker_stall_timeout has to be positive")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout has to be positive")
+	check(oneOf(c.LoginThrottle, "postgres", "memory", "off"), "login_throttle %q is not postgres, memory or off", c.LoginThrottle)
+	check(oneOf(c.RateLimit, "postgres", "memory", "off"), "rate_limit %q is not postgres, memory or off", c.RateLimit)
+	check(oneOf(c.Traces, "otlp", "stdout", "file", "off", ""), "traces_exporter %q is not otlp, stdout, file or off", c.Traces)
+	var level zapcore.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log_level %q is not debug, info, warn or error", c.LogLevel)
+	if _, err := logging.ParseSampling(c.LogSampling); err != nil {
+		errs = append(errs, "log_sampling: "+err.Error())
+	}
+	if _, err := c.TrustedProxyNets(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if c.Environment == Production {
+		def := defaults()
+		check(c.Key != def.Key, "key is the default one, it is known to everybody")
+		check(c.DBpath != def.DBpath, "database_uri is the default one with a well known password")
+		check(!c.Debug, "debug logging writes personal data, it is not allowed in production")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Print writes the effective config as YAML, the key and the password of the db are hidden
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(c.redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redacted is the config which may be shown, the key and the password of the db are hidden. The password may be
+// in the user info or in password and sslpassword parameters of the URI, a keyword/value DSN is hidden as a whole.
+func (c Config) redacted() Config {
+	c.Key = logging.Redacted
+	u, err := url.Parse(c.DBpath)
+	if err != nil || !oneOf(u.Scheme, "postgres", "postgresql") {
+		c.DBpath = logging.Redacted
+		return c
+	}
+	u.RawQuery = logging.RedactQuery(u.Query())
+	c.DBpath = u.Redacted()
+	return c
+}
+
+func oneOf(v string, values ...string) bool {
+	for _, s := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isHostPort(s string) bool {
+	_, port, err := net.SplitHostPort(s)
+	return err == nil && port != ""
+}
+
+func isURL(s string, schemes ...string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Host != "" && oneOf(u.Scheme, schemes...)
+}
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+)
+
+// recentSize is how many last event ids are remembered to drop duplicates
+// coming both from this instance and from pg notifications
+const recentSize = 1024
+
+// subscriberBuffer is how many events can wait for a slow subscriber before new ones are dropped
+const subscriberBuffer = 64
+
+// Broker delivers order events to subscribers of the user who owns the order
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[int64]map[chan models.OrderEvent]struct{}
+	seen   map[int64]struct{}
+	recent []int64
+	next   int
+	closed bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs:   make(map[int64]map[chan models.OrderEvent]struct{}),
+		seen:   make(map[int64]struct{}, recentSize),
+		recent: make([]int64, recentSize),
+	}
+}
+
+// Subscribe returns channel with events of the user and a function which has to be called to unsubscribe
+func (b *Broker) Subscribe(userID int64) (<-chan models.OrderEvent, func()) {
+	ch := make(chan models.OrderEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan models.OrderEvent]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[userID], ch)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+	}
+}
+
+// Publish sends event to all subscribers of its user, events which were already published are skipped
+func (b *Broker) Publish(ev models.OrderEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.seen[ev.ID]; ok || b.closed {
+		return
+	}
+	delete(b.seen, b.recent[b.next])
+	b.recent[b.next] = ev.ID
+	b.seen[ev.ID] = struct{}{}
+	b.next = (b.next + 1) % recentSize
+
+	for ch := range b.subs[ev.UserID] {
+		select {
+		case ch <- ev:
+		default:
+			// subscriber is too slow, it can catch up with Last-Event-ID after reconnect
+		}
+	}
+}
+
+// Close ends all subscriptions by closing their channels, so that streams end on shutdown
+// instead of keeping the server waiting for them
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, chans := range b.subs {
+		for ch := range chans {
+			close(ch)
+		}
+	}
+	b.subs = make(map[int64]map[chan models.OrderEvent]struct{})
+}
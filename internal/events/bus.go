@@ -0,0 +1,33 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+)
+
+// Bus delivers domain events to handlers inside the process
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []func(models.DomainEvent)
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe adds handler called for every published event, handlers should not block
+func (b *Bus) Subscribe(fn func(models.DomainEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, fn)
+}
+
+// Publish calls all handlers one after another
+func (b *Bus) Publish(ev models.DomainEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.handlers {
+		fn(ev)
+	}
+}
@@ -0,0 +1,144 @@
+// Package grpcserver serves gRPC API of the service, it uses the same app and storage logic as HTTP handlers
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	pb "github.com/GoSeoTaxi/t1/pkg/api/gophermart/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// publicPrefix marks methods which can be called without a token
+const publicPrefix = "/gophermart.v1.Users/"
+
+// methodPerms are the permissions required by the methods, the same as for the routes of HTTP API
+var methodPerms = map[string]models.Permission{
+	"/gophermart.v1.Orders/UploadOrder":      models.PermOrdersWrite,
+	"/gophermart.v1.Orders/ListOrders":       models.PermOrdersRead,
+	"/gophermart.v1.Orders/GetOrder":         models.PermOrdersRead,
+	"/gophermart.v1.Balance/GetBalance":      models.PermBalanceRead,
+	"/gophermart.v1.Balance/Withdraw":        models.PermWithdraw,
+	"/gophermart.v1.Balance/ListWithdrawals": models.PermBalanceRead,
+}
+
+// Server implements all gRPC services of the API
+type Server struct {
+	pb.UnimplementedUsersServer
+	pb.UnimplementedOrdersServer
+	pb.UnimplementedBalanceServer
+
+	db     storage.DBinterface
+	svc    *app.Service
+	logger *zap.Logger
+}
+
+// NewServer creates gRPC server with all services registered. Tokens are signed with the same
+// keys as in HTTP API, so a token got from one of them is valid in the other. Options of the service
+// have to be the same as in HTTP API too, e.g. the login throttle.
+func NewServer(db storage.DBinterface, tokenAuth *app.TokenAuth, logger *zap.Logger, opts ...app.ServiceOption) *grpc.Server {
+	s := &Server{
+		db:     db,
+		svc:    app.NewService(db, tokenAuth, opts...),
+		logger: logger,
+	}
+
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(s.logRequests, requestMeta, s.authenticate))
+	pb.RegisterUsersServer(srv, s)
+	pb.RegisterOrdersServer(srv, s)
+	pb.RegisterBalanceServer(srv, s)
+	return srv
+}
+
+func (s *Server) logRequests(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	s.logger.Debug("grpc request", zap.String("method", info.FullMethod), zap.String("code", status.Code(err).String()),
+		zap.Duration("duration", time.Since(start)))
+	return resp, err
+}
+
+// requestMeta puts address of the peer and x-request-id sent by the client into context for audit events
+func requestMeta(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var m app.RequestMeta
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		m.IP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(m.IP); err == nil {
+			m.IP = host
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get("x-request-id"); len(ids) > 0 {
+		m.RequestID = ids[0]
+	}
+	return handler(app.WithRequestMeta(ctx, m), req)
+}
+
+// authenticate checks jwt from "authorization" metadata, it is accepted both with and without Bearer prefix.
+// Role of the user in the db has to have the permission of the method, the role claim of the token is not trusted.
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, publicPrefix) {
+		return handler(ctx, req)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "token is required")
+	}
+	token := strings.TrimSpace(values[0])
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	}
+
+	ctx, err := s.svc.Authenticate(ctx, token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "token is not valid")
+	}
+
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	role, blocked, err := s.db.SelectUserAccess(ctx, user)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return nil, status.Error(codes.Unauthenticated, "user does not exist")
+	} else if err != nil {
+		return nil, s.internalError(info.FullMethod, err)
+	} else if blocked {
+		return nil, status.Error(codes.PermissionDenied, "account is blocked")
+	}
+
+	ctx = app.WithRole(ctx, role)
+	perm, ok := methodPerms[info.FullMethod]
+	if !ok || !models.RoleHas(role, perm) {
+		return nil, status.Error(codes.PermissionDenied, "not enough rights")
+	}
+	return handler(ctx, req)
+}
+
+// userID gets the user authenticated by the interceptor
+func userID(ctx context.Context) (int64, error) {
+	id, err := app.UserIDFromContext(ctx)
+	if err != nil {
+		return 0, status.Error(codes.Unauthenticated, "user is not authenticated")
+	}
+	return id, nil
+}
+
+// internalError logs the error and hides it from the client
+func (s *Server) internalError(method string, err error) error {
+	s.logger.Error("internal error", zap.String("method", method), zap.Error(err))
+	return status.Error(codes.Internal, "internal server error")
+}
@@ -0,0 +1,203 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	pb "github.com/GoSeoTaxi/t1/pkg/api/gophermart/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{balance: models.Balance{Current: 1000}, owners: map[int64]int64{}}
+	conn := dial(t, db)
+	users, orders, balance := pb.NewUsersClient(conn), pb.NewOrdersClient(conn), pb.NewBalanceClient(conn)
+
+	_, err := balance.GetBalance(ctx, &pb.GetBalanceRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = users.Register(ctx, &pb.Credentials{Login: "taken", Password: "pass"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = users.Login(ctx, &pb.Credentials{Login: "user", Password: "wrong"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	auth, err := users.Login(ctx, &pb.Credentials{Login: "user", Password: "pass"})
+	require.NoError(t, err)
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+auth.Token)
+
+	uploaded, err := orders.UploadOrder(ctx, &pb.UploadOrderRequest{Number: "12345678903"})
+	require.NoError(t, err)
+	assert.True(t, uploaded.Accepted)
+	uploaded, err = orders.UploadOrder(ctx, &pb.UploadOrderRequest{Number: "12345678903"})
+	require.NoError(t, err)
+	assert.False(t, uploaded.Accepted)
+	_, err = orders.UploadOrder(ctx, &pb.UploadOrderRequest{Number: "12345678901"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = orders.UploadOrder(ctx, &pb.UploadOrderRequest{Number: "2377225624"})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	list, err := orders.ListOrders(ctx, &pb.ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Orders, 1)
+	assert.Equal(t, "12345678903", list.Orders[0].Number)
+	assert.Equal(t, pb.OrderStatus_ORDER_STATUS_PROCESSED, list.Orders[0].Status)
+	assert.Equal(t, 5.5, list.Orders[0].Accrual)
+
+	_, err = orders.GetOrder(ctx, &pb.GetOrderRequest{Number: "2377225624"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	b, err := balance.GetBalance(ctx, &pb.GetBalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, b.Current)
+
+	_, err = balance.Withdraw(ctx, &pb.WithdrawRequest{Order: "79927398713", Sum: 11})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = balance.Withdraw(ctx, &pb.WithdrawRequest{Order: "79927398713", Sum: 7.5})
+	require.NoError(t, err)
+	assert.Equal(t, int64(-750), db.inserted[len(db.inserted)-1].Amount)
+	if assert.Len(t, db.audit, 4) {
+		assert.Equal(t, models.AuditLoginFailed, db.audit[0].Action)
+		assert.Equal(t, models.AuditLoginSucceeded, db.audit[1].Action)
+		assert.Equal(t, models.AuditOrderUploaded, db.audit[2].Action)
+		assert.Equal(t, models.AuditWithdrawal, db.audit[3].Action)
+		assert.Equal(t, int64(11), db.audit[3].ActorID)
+	}
+
+	_, err = pb.NewOrdersClient(conn).ListOrders(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer broken"),
+		&pb.ListOrdersRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServer_SharedToken(t *testing.T) {
+	// token issued by HTTP API is signed with the same secret
+	token, err := app.NewTokenAuth("test").Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+
+	db := &fakeDB{balance: models.Balance{Current: 250, Withdrawn: -100}}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+	b, err := pb.NewBalanceClient(dial(t, db)).GetBalance(ctx, &pb.GetBalanceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, b.Current)
+	assert.Equal(t, 1.0, b.Withdrawn)
+}
+
+func dial(t *testing.T, db storage.DBinterface) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	srv := NewServer(db, app.NewTokenAuth("test"), zap.NewNop())
+	go srv.Serve(lis)
+	t.Cleanup(srv.GracefulStop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeDB implements only the methods used by gRPC services, others panic
+type fakeDB struct {
+	storage.DBinterface
+	balance  models.Balance
+	owners   map[int64]int64
+	inserted []models.Order
+	blocked  bool
+	role     string
+	audit    []models.AuditEvent
+}
+
+func (db *fakeDB) CreateNewUser(ctx context.Context, u *models.User, audit models.AuditEvent) (int, error) {
+	if u.Login == "taken" {
+		return -1, errors.New("user already exists")
+	}
+	u.ID = 11
+	return 1, nil
+}
+
+func (db *fakeDB) SelectPass(ctx context.Context, u *models.User) (*string, error) {
+	np := sha256.Sum256([]byte("pass"))
+	pass := hex.EncodeToString(np[:])
+	u.ID = 11
+	return &pass, nil
+}
+
+func (db *fakeDB) InsertOrder(ctx context.Context, o models.Order, audit models.AuditEvent) error {
+	if o.ID == 2377225624 {
+		return storage.ErrOrderConflict
+	}
+	if owner, ok := db.owners[o.ID]; ok && owner == o.UserID {
+		return storage.ErrOrderExists
+	}
+	db.owners[o.ID] = o.UserID
+	db.inserted = append(db.inserted, o)
+	db.audit = append(db.audit, audit)
+	return nil
+}
+
+func (db *fakeDB) InsertAudit(ctx context.Context, ev models.AuditEvent) error {
+	db.audit = append(db.audit, ev)
+	return nil
+}
+
+func (db *fakeDB) SelectAllOrders(ctx context.Context, user int64) ([]*models.Order, error) {
+	return []*models.Order{{ID: 12345678903, Status: "PROCESSED", Amount: 550, UserID: user, Date: time.Now()}}, nil
+}
+
+func (db *fakeDB) SelectOrder(ctx context.Context, number int64) (*models.Order, error) {
+	return &models.Order{ID: number, UserID: 12, Status: "NEW"}, nil
+}
+
+func (db *fakeDB) SelectBalance(ctx context.Context, user int64) (*models.Balance, error) {
+	b := db.balance
+	return &b, nil
+}
+
+func (db *fakeDB) SelectUserAccess(ctx context.Context, id int64) (string, bool, error) {
+	if db.role == "" {
+		return models.RoleUser, db.blocked, nil
+	}
+	return db.role, db.blocked, nil
+}
+
+func TestServer_BlockedUser(t *testing.T) {
+	token, err := app.NewTokenAuth("test").Encode(map[string]interface{}{"user_id": 11})
+	require.NoError(t, err)
+
+	conn := dial(t, &fakeDB{blocked: true})
+	_, err = pb.NewUsersClient(conn).Login(context.Background(), &pb.Credentials{Login: "user", Password: "pass"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+	_, err = pb.NewBalanceClient(conn).GetBalance(ctx, &pb.GetBalanceRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestServer_Permissions(t *testing.T) {
+	// the claim is left from the time the user was a customer, the role in the db is what counts
+	token, err := app.NewTokenAuth("test").Encode(map[string]interface{}{"user_id": 11, "role": models.RoleUser})
+	require.NoError(t, err)
+
+	conn := dial(t, &fakeDB{owners: map[int64]int64{}, role: models.RolePartner})
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", token)
+	_, err = pb.NewOrdersClient(conn).UploadOrder(ctx, &pb.UploadOrderRequest{Number: "12345678903"})
+	assert.NoError(t, err)
+	_, err = pb.NewBalanceClient(conn).GetBalance(ctx, &pb.GetBalanceRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,265 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	pb "github.com/GoSeoTaxi/t1/pkg/api/gophermart/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *Server) Register(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	u, err := credentials(req)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.svc.Register(ctx, u)
+	if errors.Is(err, app.ErrLoginTaken) {
+		return nil, status.Error(codes.AlreadyExists, "login is already taken")
+	} else if err != nil {
+		return nil, s.internalError("Register", err)
+	}
+	return &pb.AuthResponse{Token: token}, nil
+}
+
+func (s *Server) Login(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	u, err := credentials(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var throttled *app.ThrottledError
+	token, err := s.svc.Login(ctx, u)
+	if errors.Is(err, app.ErrWrongCredentials) {
+		return nil, status.Error(codes.Unauthenticated, "login or password is wrong")
+	} else if errors.Is(err, app.ErrUserBlocked) {
+		return nil, status.Error(codes.PermissionDenied, "account is blocked")
+	} else if errors.As(err, &throttled) {
+		// the same as Retry-After header of HTTP API
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds())))))
+		return nil, status.Error(codes.ResourceExhausted, "too many failed attempts, try again later")
+	} else if err != nil {
+		return nil, s.internalError("Login", err)
+	}
+	return &pb.AuthResponse{Token: token}, nil
+}
+
+// credentials makes user with hashed password the same way as HTTP API does
+func credentials(req *pb.Credentials) (*models.User, error) {
+	if req.Login == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "login and password are required")
+	}
+	return &models.User{Login: req.Login, Password: models.HashPassword(req.Password)}, nil
+}
+
+func (s *Server) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	number, err := orderNumber(ctx, req.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.svc.UploadOrder(ctx, user, number)
+	if errors.Is(err, storage.ErrOrderExists) {
+		return &pb.UploadOrderResponse{Accepted: false}, nil
+	} else if errors.Is(err, storage.ErrOrderConflict) {
+		return nil, status.Error(codes.AlreadyExists, "order was uploaded by different user")
+	} else if err != nil {
+		return nil, s.internalError("UploadOrder", err)
+	}
+	return &pb.UploadOrderResponse{Accepted: true}, nil
+}
+
+func (s *Server) ListOrders(ctx context.Context, req *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, paged, err := orderFilter(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []*models.Order
+	resp := &pb.ListOrdersResponse{}
+	if paged {
+		limit := filter.Limit
+		filter.Limit++
+		orders, err = s.db.SelectOrders(ctx, user, filter)
+		if err == nil && len(orders) > limit {
+			orders = orders[:limit]
+			resp.NextPageToken = models.OrderCursor{Date: orders[limit-1].Date, Seq: orders[limit-1].Seq}.Encode()
+		}
+	} else {
+		orders, err = s.db.SelectAllOrders(ctx, user)
+	}
+	if err != nil {
+		return nil, s.internalError("ListOrders", err)
+	}
+
+	for _, o := range orders {
+		resp.Orders = append(resp.Orders, orderToPB(o))
+	}
+	return resp, nil
+}
+
+// orderFilter is the same as app.ParseOrderFilter makes from query of HTTP request,
+// request without any parameter lists all uploaded orders
+func orderFilter(req *pb.ListOrdersRequest) (models.OrderFilter, bool, error) {
+	f := models.OrderFilter{Type: "top_up", Limit: app.DefaultPageSize, Desc: req.Desc}
+	paged := req.PageSize != 0 || req.PageToken != "" || len(req.Statuses) > 0 || req.Withdrawals ||
+		req.From != nil || req.To != nil || req.Desc
+
+	if req.PageSize < 0 || req.PageSize > app.MaxPageSize {
+		return f, paged, status.Errorf(codes.InvalidArgument, "page_size should be from 0 to %d", app.MaxPageSize)
+	} else if req.PageSize > 0 {
+		f.Limit = int(req.PageSize)
+	}
+
+	if req.PageToken != "" {
+		c, err := models.DecodeOrderCursor(req.PageToken)
+		if err != nil {
+			return f, paged, status.Error(codes.InvalidArgument, "page_token is not valid")
+		}
+		f.After = c
+	}
+
+	for _, st := range req.Statuses {
+		if st == pb.OrderStatus_ORDER_STATUS_UNSPECIFIED {
+			return f, paged, status.Error(codes.InvalidArgument, "status should be specified")
+		}
+		f.Statuses = append(f.Statuses, strings.TrimPrefix(st.String(), "ORDER_STATUS_"))
+	}
+
+	if req.Withdrawals {
+		f.Type = "withdraw"
+	}
+	if req.From != nil {
+		f.From = req.From.AsTime()
+	}
+	if req.To != nil {
+		f.To = req.To.AsTime()
+	}
+
+	return f, paged, nil
+}
+
+func (s *Server) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.Order, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	number, err := orderNumber(ctx, req.Number)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := s.db.SelectOrder(ctx, number)
+	if errors.Is(err, storage.ErrOrderNotFound) {
+		return nil, status.Error(codes.NotFound, "order not found")
+	} else if err != nil {
+		return nil, s.internalError("GetOrder", err)
+	} else if order.UserID != user {
+		return nil, status.Error(codes.PermissionDenied, "order was uploaded by different user")
+	}
+	return orderToPB(order), nil
+}
+
+func (s *Server) GetBalance(ctx context.Context, req *pb.GetBalanceRequest) (*pb.BalanceResponse, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := s.db.SelectBalance(ctx, user)
+	if err != nil {
+		return nil, s.internalError("GetBalance", err)
+	}
+	return &pb.BalanceResponse{
+		Current:   float64(balance.Current) / 100,
+		Withdrawn: math.Abs(float64(balance.Withdrawn)) / 100,
+	}, nil
+}
+
+func (s *Server) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	number, err := orderNumber(ctx, req.Order)
+	if err != nil {
+		return nil, err
+	}
+	if req.Sum <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "sum should be positive")
+	}
+
+	err = s.svc.Withdraw(ctx, user, models.Withdrawal{ID: number, Amount: int64(math.Round(req.Sum * 100))})
+	if errors.Is(err, app.ErrInsufficientFunds) {
+		return nil, status.Error(codes.FailedPrecondition, "current balance is not enough")
+	} else if errors.Is(err, storage.ErrOrderExists) || errors.Is(err, storage.ErrOrderConflict) {
+		return nil, status.Error(codes.AlreadyExists, "order number was already used")
+	} else if err != nil {
+		return nil, s.internalError("Withdraw", err)
+	}
+	return &pb.WithdrawResponse{}, nil
+}
+
+func (s *Server) ListWithdrawals(ctx context.Context, req *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	user, err := userID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	withdrawals, err := s.db.SelectAllWithdrawals(ctx, user)
+	if err != nil {
+		return nil, s.internalError("ListWithdrawals", err)
+	}
+
+	resp := &pb.ListWithdrawalsResponse{}
+	for _, w := range *withdrawals {
+		resp.Withdrawals = append(resp.Withdrawals, &pb.Withdrawal{
+			Order:       fmt.Sprint(w.ID),
+			Sum:         math.Abs(float64(w.Amount)) / 100,
+			ProcessedAt: timestamppb.New(w.Date),
+		})
+	}
+	return resp, nil
+}
+
+func orderNumber(ctx context.Context, number string) (int64, error) {
+	valid, id, err := app.PrepOrderNumber(ctx, []byte(number))
+	if err != nil || !valid {
+		return 0, status.Error(codes.InvalidArgument, "wrong format of the order number")
+	}
+	return id, nil
+}
+
+func orderToPB(o *models.Order) *pb.Order {
+	order := &pb.Order{
+		Number:     fmt.Sprint(o.ID),
+		Status:     pb.OrderStatus(pb.OrderStatus_value["ORDER_STATUS_"+o.Status]),
+		Accrual:    math.Abs(float64(o.Amount)) / 100,
+		UploadedAt: timestamppb.New(o.Date),
+	}
+	if !o.CheckedAt.IsZero() {
+		order.CheckedAt = timestamppb.New(o.CheckedAt)
+	}
+	return order
+}
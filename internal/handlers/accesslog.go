@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/logging"
+	"github.com/GoSeoTaxi/t1/internal/observe"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// quietRoutes are polled by orchestrators and Prometheus, their requests are logged at debug level
+var quietRoutes = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// accessLog writes one entry for every request after it is served. It has to go after the Verifier of tokens
+// to know the user, and before Recoverer so that requests ending in panic are logged as 500.
+// Bodies and headers are never logged, values of sensitive query parameters are redacted.
+func (h *Handler) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := observe.Serve(next, w, r)
+
+		level := zapcore.InfoLevel
+		if res.Status >= http.StatusInternalServerError {
+			level = zapcore.ErrorLevel
+		} else if quietRoutes[res.Route] {
+			level = zapcore.DebugLevel
+		}
+		ce := h.logger.Check(level, "request")
+		if ce == nil {
+			return
+		}
+
+		meta := requestMeta(r)
+		fields := []zap.Field{
+			zap.String("request_id", meta.RequestID),
+			zap.String("method", r.Method),
+			zap.String("route", res.Route),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", res.Status),
+			zap.Duration("duration", res.Duration),
+			zap.Int("size", res.Size),
+			zap.String("ip", meta.IP),
+		}
+		if r.URL.RawQuery != "" {
+			fields = append(fields, zap.String("query", logging.RedactQuery(r.URL.Query())))
+		}
+		if userID, err := app.UserIDFromContext(r.Context()); err == nil {
+			fields = append(fields, zap.Int64("user", userID))
+		}
+		ce.Write(fields...)
+	})
+}
@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// searchLimit is the max amount of users found by admin search
+const searchLimit = 50
+
+// activeUser rejects requests of blocked users, their tokens stay valid but useless. Current role of the user
+// is put into context for requirePermission.
+func (h *Handler) activeUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		role, blocked, err := h.db.SelectUserAccess(h.spanCtx(r), currUser)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user does not exist")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if blocked {
+			writeProblem(w, r, http.StatusForbidden, CodeAccountBlocked, "account is blocked")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(app.WithRole(r.Context(), role)))
+	})
+}
+
+// requirePermission lets through only users whose role has all the permissions, it goes after activeUser
+func requirePermission(perms ...models.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, err := app.RoleFromContext(r.Context())
+			if err != nil {
+				writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+				return
+			}
+
+			if !models.RoleHas(role, perms...) {
+				writeProblem(w, r, http.StatusForbidden, CodeForbidden, "not enough rights")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userParam gets id of the user from the route
+func userParam(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("wrong user id: %s", err))
+		return 0, false
+	}
+	return id, true
+}
+
+// checkTarget rejects staff actions on their own account and on accounts of roles out of their scope,
+// otherwise support could credit themselves or block admins
+func (h *Handler) checkTarget(w http.ResponseWriter, r *http.Request, id int64) bool {
+	actor, err := app.UserIDFromContext(r.Context())
+	if err != nil {
+		writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+		return false
+	}
+	if actor == id {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, "staff can't change their own account")
+		return false
+	}
+	role, err := app.RoleFromContext(r.Context())
+	if err != nil {
+		writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+		return false
+	}
+
+	target, _, err := h.db.SelectUserAccess(h.spanCtx(r), id)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		writeProblem(w, r, http.StatusNotFound, CodeUserNotFound, "user not found")
+		return false
+	} else if err != nil {
+		h.internalError(w, r, err)
+		return false
+	}
+	if !models.CanActOn(role, target) {
+		writeProblem(w, r, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s can't change accounts of %s", role, target))
+		return false
+	}
+	return true
+}
+
+// decodeReason reads the mandatory reason of a staff action
+func decodeReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
+		return "", false
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "reason is required")
+		return "", false
+	}
+	return req.Reason, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	mJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(mJSON)
+	return nil
+}
+
+func (h *Handler) HandlerAdminSearchUsers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "search query q is required")
+			return
+		}
+
+		users, err := h.db.SearchUsers(h.spanCtx(r), q, searchLimit)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if len(users) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		list := make([]*models.UserInfo, len(users))
+		for i := range users {
+			list[i] = &users[i]
+		}
+		if err := writeJSON(w, http.StatusOK, list); err != nil {
+			h.internalError(w, r, err)
+		}
+	}
+}
+
+func (h *Handler) HandlerAdminGetUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+
+		user, err := h.db.SelectUser(h.spanCtx(r), id)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeUserNotFound, "user not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		if err := writeJSON(w, http.StatusOK, user); err != nil {
+			h.internalError(w, r, err)
+		}
+	}
+}
+
+// HandlerAdminGetUserOrders lists orders of the user with the same parameters as the user's own list
+func (h *Handler) HandlerAdminGetUserOrders() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+		h.writeOrders(w, r, id)
+	}
+}
+
+func (h *Handler) HandlerAdminGetLedger() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+
+		ledger, err := h.db.SelectLedger(h.spanCtx(r), id)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if len(ledger) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		entries := make([]*models.LedgerEntry, len(ledger))
+		for i := range ledger {
+			entries[i] = &ledger[i]
+		}
+		if err := writeJSON(w, http.StatusOK, entries); err != nil {
+			h.internalError(w, r, err)
+		}
+	}
+}
+
+func (h *Handler) HandlerAdminAdjustBalance() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+
+		var adj models.Adjustment
+		if err := json.NewDecoder(r.Body).Decode(&adj); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
+			return
+		} else if adj.Amount == 0 {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "amount should not be zero")
+			return
+		} else if strings.TrimSpace(adj.Reason) == "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "reason is required")
+			return
+		}
+		adj.UserID = id
+		if !h.checkTarget(w, r, id) {
+			return
+		}
+
+		err := h.db.AdjustBalance(h.spanCtx(r), adj, auditEvent(r, models.AuditBalanceAdjusted, models.UserTarget(id), adj.Reason))
+		if errors.Is(err, storage.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeUserNotFound, "user not found")
+			return
+		} else if errors.Is(err, storage.ErrInsufficientFunds) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInsufficientFunds, "debit is bigger than the balance")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Info("balance adjusted", zap.Int64("user", id), zap.Int64("amount", adj.Amount))
+		writeOK(w, http.StatusCreated)
+	}
+}
+
+// HandlerAdminSetBlocked blocks or unblocks the user
+func (h *Handler) HandlerAdminSetBlocked(blocked bool) http.HandlerFunc {
+	action := models.AuditUserUnblocked
+	if blocked {
+		action = models.AuditUserBlocked
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+		reason, ok := decodeReason(w, r)
+		if !ok || !h.checkTarget(w, r, id) {
+			return
+		}
+
+		err := h.db.SetUserBlocked(h.spanCtx(r), id, blocked, auditEvent(r, action, models.UserTarget(id), reason))
+		if errors.Is(err, storage.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeUserNotFound, "user not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Info(action, zap.Int64("user", id))
+		writeOK(w, http.StatusOK)
+	}
+}
+
+// HandlerAdminSetRole changes the role of the user, it takes effect on the next request of the user
+func (h *Handler) HandlerAdminSetRole() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := userParam(w, r)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Role   string `json:"role"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
+			return
+		} else if !models.ValidRole(req.Role) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidRole, fmt.Sprintf("unknown role %q", req.Role))
+			return
+		} else if strings.TrimSpace(req.Reason) == "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "reason is required")
+			return
+		}
+		if !h.checkTarget(w, r, id) {
+			return
+		}
+		if role, _ := app.RoleFromContext(r.Context()); !models.CanActOn(role, req.Role) {
+			writeProblem(w, r, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s can't grant role %s", role, req.Role))
+			return
+		}
+
+		err := h.db.SetUserRole(h.spanCtx(r), id, req.Role, auditEvent(r, models.AuditRoleChanged, models.UserTarget(id), req.Reason))
+		if errors.Is(err, storage.ErrUserNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeUserNotFound, "user not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Info("role changed", zap.Int64("user", id), zap.String("role", req.Role))
+		writeOK(w, http.StatusOK)
+	}
+}
+
+// HandlerAdminUnlockLogin lifts lockout after failed logins from the login, the IP or both
+func (h *Handler) HandlerAdminUnlockLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Login  string `json:"login"`
+			IP     string `json:"ip"`
+			Reason string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
+			return
+		} else if req.Login == "" && req.IP == "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "login or ip is required")
+			return
+		} else if strings.TrimSpace(req.Reason) == "" {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "reason is required")
+			return
+		}
+
+		actor, _ := app.UserIDFromContext(r.Context())
+		if err := h.svc.UnlockLogin(h.withMeta(r), actor, req.Login, req.IP, req.Reason); err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Info("login unlocked", zap.String("login", req.Login), zap.String("ip", req.IP))
+		writeOK(w, http.StatusOK)
+	}
+}
+
+func (h *Handler) HandlerAdminRequeueOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		valid, number, err := app.PrepOrderNumber(h.spanCtx(r), []byte(chi.URLParam(r, "number")))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not parse order number: %s", err))
+			return
+		} else if !valid {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "wrong format of the order number")
+			return
+		}
+		reason, ok := decodeReason(w, r)
+		if !ok {
+			return
+		}
+
+		err = h.db.RequeueOrder(h.spanCtx(r), number, auditEvent(r, models.AuditOrderRequeued, models.OrderTarget(number), reason))
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeOrderNotFound, "order not found")
+			return
+		} else if errors.Is(err, storage.ErrOrderProcessed) {
+			writeProblem(w, r, http.StatusConflict, CodeOrderProcessed, "order is already processed")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Info("order requeued", zap.Int64("order", number))
+		writeOK(w, http.StatusOK)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// requestMeta takes IP of the client set by realIP and id of the request
+func requestMeta(r *http.Request) app.RequestMeta {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return app.RequestMeta{IP: ip, RequestID: middleware.GetReqID(r.Context())}
+}
+
+// spanCtx is the context of the handler with the span of the request, so that calls of the db are traced
+// as a part of the request
+func (h *Handler) spanCtx(r *http.Request) context.Context {
+	return trace.ContextWithSpan(h.ctx, trace.SpanFromContext(r.Context()))
+}
+
+// withMeta is the context of the handler with meta of the request for audit events written by the service
+func (h *Handler) withMeta(r *http.Request) context.Context {
+	return app.WithRequestMeta(h.spanCtx(r), requestMeta(r))
+}
+
+// auditEvent starts audit record of the action made by the current user
+func auditEvent(r *http.Request, action string, target string, reason string) models.AuditEvent {
+	actor, _ := app.UserIDFromContext(r.Context())
+	return app.NewAuditEvent(app.WithRequestMeta(r.Context(), requestMeta(r)), actor, action, target, reason)
+}
+
+// parseAuditFilter reads filter of the export from query, time is expected in RFC3339
+func parseAuditFilter(r *http.Request) (models.AuditFilter, error) {
+	q := r.URL.Query()
+	f := models.AuditFilter{Target: q.Get("target"), Action: q.Get("action")}
+
+	if actor := q.Get("actor"); actor != "" {
+		id, err := strconv.ParseInt(actor, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("wrong actor: %v", err)
+		}
+		f.ActorID = id
+	}
+	for name, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("wrong %s: %v", name, err)
+			}
+			*t = parsed
+		}
+	}
+
+	return f, nil
+}
+
+// HandlerAdminExportAudit streams audit events as newline delimited json from the oldest one
+func (h *Handler) HandlerAdminExportAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		started := false
+		err = h.db.ExportAudit(r.Context(), filter, func(ev models.AuditEvent) error {
+			line, err := json.Marshal(&ev)
+			if err != nil {
+				return err
+			}
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				w.Header().Set("Content-Disposition", `attachment; filename="audit.ndjson"`)
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			_, err = w.Write(append(line, '\n'))
+			return err
+		})
+
+		if err != nil && !started {
+			h.internalError(w, r, err)
+			return
+		} else if err != nil {
+			// the response is already sent partially, the client sees it is cut
+			if !errors.Is(err, context.Canceled) {
+				h.logger.Error("audit export failed", zap.Error(err))
+			}
+			return
+		} else if !started {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
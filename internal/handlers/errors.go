@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+)
+
+// Stable error codes returned in "code" member of problem details, clients should rely on them
+// rather than on the human readable detail
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeWrongContentType   = "wrong_content_type"
+	CodeWrongEncoding      = "wrong_encoding"
+	CodeUnauthorized       = "unauthorized"
+	CodeWrongCredentials   = "wrong_credentials"
+	CodeLoginTaken         = "login_taken"
+	CodeInvalidOrderNumber = "invalid_order_number"
+	CodeOrderConflict      = "order_conflict"
+	CodeOrderNumberUsed    = "order_number_used"
+	CodeOrderNotFound      = "order_not_found"
+	CodeOrderForbidden     = "order_forbidden"
+	CodeInsufficientFunds  = "insufficient_funds"
+	CodeBatchTooLarge      = "batch_too_large"
+	CodeInvalidWebhook     = "invalid_webhook"
+	CodeWebhookNotFound    = "webhook_not_found"
+	CodeForbidden          = "forbidden"
+	CodeAccountBlocked     = "account_blocked"
+	CodeUserNotFound       = "user_not_found"
+	CodeOrderProcessed     = "order_processed"
+	CodeInvalidRole        = "invalid_role"
+	CodeTooManyAttempts    = "too_many_attempts"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeInternal           = "internal_error"
+)
+
+// Problem is an error response in RFC 7807 format extended with error code and request id
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeProblem renders error response as application/problem+json
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	p := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// internalError logs the error and tells client only that something went wrong,
+// request id in the response allows to find the log record
+func (h *Handler) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.Error("internal error", zap.Error(err), zap.String("request_id", middleware.GetReqID(r.Context())),
+		zap.String("path", r.URL.Path))
+	writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
+}
+
+// writeOK replies with a short json status for endpoints which have nothing else to return
+func writeOK(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(`{"status":"ok"}`))
+}
@@ -2,102 +2,128 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/events"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"context"
 	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/ratelimit"
 	"github.com/GoSeoTaxi/t1/internal/storage"
-	"github.com/go-chi/jwtauth/v5"
+	"github.com/GoSeoTaxi/t1/internal/throttle"
+	"github.com/GoSeoTaxi/t1/internal/tracing"
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"strings"
 )
 
+// defaultBatchLimit is the max amount of orders in one batch upload unless set by WithBatchLimit
+const defaultBatchLimit = 100
+
+// maxOrderBytes is room for one order number of the batch with quotes, separators and whitespace, the body of the batch
+// is read up to batchLimit of them, so that a huge or well compressed body is not read into memory before it is counted
+const maxOrderBytes = 64
+
+// heartbeatInterval is how often a comment is sent to an idle event stream so that proxies keep it open
+const heartbeatInterval = 15 * time.Second
+
 type Handler struct {
-	db     storage.DBinterface
-	logger *zap.Logger
-	ctx    context.Context
+	db         storage.DBinterface
+	logger     *zap.Logger
+	ctx        context.Context
+	svc        *app.Service
+	batchLimit int
+	events     *events.Broker
+	throttle   *throttle.Limiter
+
+	rateLimiter    *ratelimit.Limiter
+	checks         []Check
+	trustedProxies []*net.IPNet
+	ready          *readiness
+
+	reportResponse func(r *http.Request, err error)
 }
 
 func NewHandler(ctx context.Context, db storage.DBinterface, logger *zap.Logger) Handler {
 	return Handler{
-		db:     db,
-		logger: logger,
-		ctx:    ctx,
+		db:         db,
+		logger:     logger,
+		ctx:        ctx,
+		batchLimit: defaultBatchLimit,
+		events:     events.NewBroker(),
+		ready:      &readiness{},
 	}
 }
 
 // HandlerPostRegister creates new user if user with such login not yet exist
-func (h *Handler) HandlerPostRegister(tokenAuth *jwtauth.JWTAuth) http.HandlerFunc {
+func (h *Handler) HandlerPostRegister() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var u models.User
 		err := decoder.Decode(&u)
-		h.logger.Debug("recieved new user: ", zap.String("login", u.Login))
-
 		if err != nil {
-			http.Error(w, fmt.Sprintf("400 - Register json cannot be decoded: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
 			return
 		}
 
-		exists, err := h.db.CreateNewUser(h.ctx, &u)
-		if exists == -1 {
-			http.Error(w, fmt.Sprintf("409 - Login is already taken: %s", err), http.StatusConflict)
+		tokenString, err := h.svc.Register(h.withMeta(r), &u)
+		if errors.Is(err, app.ErrLoginTaken) {
+			writeProblem(w, r, http.StatusConflict, CodeLoginTaken, "login is already taken")
 			return
 		} else if err != nil {
-			http.Error(w, fmt.Sprintf("500 - Internal error: %s", err), http.StatusInternalServerError)
+			h.internalError(w, r, err)
 			return
-		} else if exists == 1 {
-
-			_, tokenString, _ := tokenAuth.Encode(map[string]interface{}{"user_id": u.ID})
-
-			h.logger.Debug("logged in: ", zap.String("login", u.Login))
-			http.SetCookie(w, &http.Cookie{
-				Name:  "jwt",
-				Value: tokenString,
-			})
-			w.Header().Set("application-type", "text/plain")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`{"status":"ok}`))
 		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:  "jwt",
+			Value: tokenString,
+		})
+		writeOK(w, http.StatusOK)
 	}
 }
 
 // HandlerPostLogin logins user if login and password are valid
-func (h *Handler) HandlerPostLogin(tokenAuth *jwtauth.JWTAuth) http.HandlerFunc {
+func (h *Handler) HandlerPostLogin() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var u models.User
 		err := decoder.Decode(&u)
-		h.logger.Debug("user is trying to login: ", zap.String("login", u.Login))
-
 		if err != nil {
-			http.Error(w, fmt.Sprintf("400 - Register json cannot be decoded: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
 			return
 		}
 
-		pass, err := h.db.SelectPass(h.ctx, &u)
-
-		if pass == nil || !app.ComparePass(*pass, u.Password) {
-			http.Error(w, fmt.Sprintf("401 - user or password are wrong: %s", err), http.StatusUnauthorized)
+		var throttled *app.ThrottledError
+		tokenString, err := h.svc.Login(h.withMeta(r), &u)
+		if errors.Is(err, app.ErrWrongCredentials) {
+			writeProblem(w, r, http.StatusUnauthorized, CodeWrongCredentials, "login or password is wrong")
+			return
+		} else if errors.Is(err, app.ErrUserBlocked) {
+			writeProblem(w, r, http.StatusForbidden, CodeAccountBlocked, "account is blocked")
+			return
+		} else if errors.As(err, &throttled) {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(throttled.RetryAfter)))
+			writeProblem(w, r, http.StatusTooManyRequests, CodeTooManyAttempts, "too many failed attempts, try again later")
 			return
 		} else if err != nil {
-			http.Error(w, fmt.Sprintf("500 - Internal error: %s", err), http.StatusInternalServerError)
+			h.internalError(w, r, err)
 			return
 		}
 
-		_, tokenString, _ := tokenAuth.Encode(map[string]interface{}{"user_id": u.ID})
-
-		h.logger.Debug("logged in: ", zap.String("login", u.Login))
 		http.SetCookie(w, &http.Cookie{
 			Name:  "jwt",
 			Value: tokenString,
 		})
-		w.Header().Set("application-type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok}`))
+		writeOK(w, http.StatusOK)
 
 	}
 }
@@ -109,60 +135,126 @@ func (h *Handler) HandlerPostOrders() http.HandlerFunc {
 		order := models.Order{}
 		orderID, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("400 - could not parse order id: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not parse order number: %s", err))
 			return
 		}
-		valid, order.ID, err = app.PrepOrderNumber(h.ctx, orderID)
+		valid, order.ID, err = app.PrepOrderNumber(h.spanCtx(r), orderID)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("400 - could not parse order id: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not parse order number: %s", err))
 			return
 		} else if !valid {
-			http.Error(w, fmt.Sprintf("422 - wrong format of the order number: %s", err), http.StatusUnprocessableEntity)
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "wrong format of the order number")
 			return
 		}
+		trace.SpanFromContext(r.Context()).SetAttributes(tracing.OrderNumber(order.ID))
 
-		h.logger.Debug("adding new order: ", zap.String("order", string(orderID)))
+		h.logger.Debug("adding new order: ", zap.Int64("order", order.ID))
 
 		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
 			h.logger.Debug(err.Error())
-			http.Error(w, fmt.Sprintf("400 - could not parse user id from token: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
 		}
 		h.logger.Debug("found user: ", zap.String("login", fmt.Sprint(currUser)))
 
-		expectedUser, err := h.db.SelectUserForOrder(h.ctx, order)
-		h.logger.Debug("found other user: ", zap.String("login", fmt.Sprint(expectedUser)))
+		err = h.svc.UploadOrder(h.withMeta(r), currUser, order.ID)
+		if errors.Is(err, storage.ErrOrderExists) {
+			writeOK(w, http.StatusOK)
+			return
+		} else if errors.Is(err, storage.ErrOrderConflict) {
+			writeProblem(w, r, http.StatusConflict, CodeOrderConflict, "order was uploaded by different user")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Debug("order accepted: ", zap.Int64("order", order.ID))
+		writeOK(w, http.StatusAccepted)
+	}
+}
 
-		if expectedUser != 0 && currUser == expectedUser {
-			w.Header().Set("application-type", "text/plain")
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`{"status":"ok}`))
+// HandlerPostOrdersBatch adds many orders at once in one transaction and tells what happened to each of them
+func (h *Handler) HandlerPostOrdersBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
-		} else if expectedUser != 0 && currUser != expectedUser {
-			http.Error(w, fmt.Sprintf("409 - Order was used by diferent user: %s", err), http.StatusConflict)
+		}
+
+		maxBytes := int64(h.batchLimit) * maxOrderBytes
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if err != nil && int64(len(body)) == maxBytes {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, CodeBatchTooLarge, fmt.Sprintf("batch can be at most %d bytes", maxBytes))
 			return
 		} else if err != nil {
-			h.logger.Debug(err.Error())
-			http.Error(w, fmt.Sprintf("500 - Internal error: %s", err), http.StatusInternalServerError)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not read batch: %s", err))
 			return
 		}
 
-		order.UserID = currUser
-		order.Status = "NEW"
-		order.Type = "top_up"
+		numbers, err := app.SplitOrderNumbers(r.Header.Get("Content-Type"), body)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not parse batch: %s", err))
+			return
+		} else if len(numbers) == 0 {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, "batch is empty")
+			return
+		} else if len(numbers) > h.batchLimit {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, CodeBatchTooLarge, fmt.Sprintf("batch can contain at most %d orders", h.batchLimit))
+			return
+		}
+
+		results := make([]models.BatchResult, len(numbers))
+		var orders []models.Order
+		var positions []int
+		for i, n := range numbers {
+			results[i].Number = n
+			valid, id, err := app.PrepOrderNumber(h.spanCtx(r), []byte(n))
+			if err != nil || !valid {
+				results[i].Result = models.BatchInvalid
+				continue
+			}
+			orders = append(orders, models.Order{ID: id, UserID: currUser, Status: "NEW", Type: "top_up"})
+			positions = append(positions, i)
+		}
 
-		err = h.db.InsertOrder(h.ctx, order)
+		accepted := 0
+		if len(orders) > 0 {
+			errs, err := h.db.InsertOrders(h.spanCtx(r), orders, auditEvent(r, models.AuditOrderUploaded, "", ""))
+			if err != nil {
+				h.internalError(w, r, err)
+				return
+			}
+			for i, err := range errs {
+				switch {
+				case errors.Is(err, storage.ErrOrderExists):
+					results[positions[i]].Result = models.BatchDuplicate
+				case errors.Is(err, storage.ErrOrderConflict):
+					results[positions[i]].Result = models.BatchConflict
+				default:
+					results[positions[i]].Result = models.BatchAccepted
+					accepted++
+				}
+			}
+		}
+
+		mJSON, err := json.Marshal(results)
 		if err != nil {
-			h.logger.Debug(err.Error())
-			http.Error(w, fmt.Sprintf("500 - Internal error: %s", err), http.StatusInternalServerError)
+			h.internalError(w, r, err)
 			return
 		}
 
-		h.logger.Debug("order accepted: ", zap.String("login", string(orderID)))
-		w.Header().Set("application-type", "text/plain")
-		w.WriteHeader(http.StatusAccepted)
-		w.Write([]byte(`{"status":"ok}`))
+		h.logger.Debug("batch of orders for user: ", zap.String("login", fmt.Sprint(currUser)),
+			zap.Int("orders", len(numbers)), zap.Int("accepted", accepted))
+		w.Header().Set("Content-Type", "application/json")
+		if accepted > 0 {
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(mJSON)
 	}
 }
 
@@ -174,34 +266,206 @@ func (h *Handler) HandlerGetOrders() http.HandlerFunc {
 
 		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("401 - could not parse user id from token: %s", err), http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
 		}
 
-		orders, err := h.db.SelectAllOrders(h.ctx, currUser)
+		h.writeOrders(w, r, currUser)
+	}
+}
+
+// writeOrders replies with orders of the user selected by query parameters of the request
+func (h *Handler) writeOrders(w http.ResponseWriter, r *http.Request, currUser int64) {
+	filter, paged, err := app.ParseOrderFilter(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("wrong list parameters: %s", err))
+		return
+	}
+
+	var orders []*models.Order
+	if paged {
+		limit := filter.Limit
+		filter.Limit++
+		orders, err = h.db.SelectOrders(h.spanCtx(r), currUser, filter)
+		if err == nil && len(orders) > limit {
+			orders = orders[:limit]
+			setNextCursor(w, r, models.OrderCursor{Date: orders[limit-1].Date, Seq: orders[limit-1].Seq})
+		}
+	} else {
+		orders, err = h.db.SelectAllOrders(h.spanCtx(r), currUser)
+	}
+
+	if err != nil {
+		h.internalError(w, r, err)
+		return
+	} else if len(orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	mJSON, err := json.Marshal(orders)
+	if err != nil {
+		h.internalError(w, r, err)
+		return
+	}
+
+	h.logger.Debug(fmt.Sprintf("list of orders for user: %d", currUser), zap.String("len", fmt.Sprint(len(orders))))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(mJSON)
+}
+
+// HandlerGetOrder gets a single order of the user with the time it was last checked in accrual system
+func (h *Handler) HandlerGetOrder() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
-		} else if len(orders) == 0 {
-			w.WriteHeader(http.StatusNoContent)
-			w.Write([]byte(`{"status":"ok}`))
+		}
+
+		valid, number, err := app.PrepOrderNumber(h.spanCtx(r), []byte(chi.URLParam(r, "number")))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("could not parse order number: %s", err))
+			return
+		} else if !valid {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidOrderNumber, "wrong format of the order number")
 			return
 		}
 
-		mJSON, err := json.Marshal(orders)
+		order, err := h.db.SelectOrder(h.spanCtx(r), number)
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeOrderNotFound, "order not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if order.UserID != currUser {
+			writeProblem(w, r, http.StatusForbidden, CodeOrderForbidden, "order was uploaded by different user")
+			return
+		}
+
+		mJSON, err := json.Marshal(order)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - could not prepare data for return: %s", err), http.StatusBadRequest)
+			h.internalError(w, r, err)
 			return
 		}
 
-		h.logger.Debug(string(mJSON))
-		h.logger.Debug(fmt.Sprintf("list of orders for user: %d", currUser), zap.String("len", fmt.Sprint(len(orders))))
+		h.logger.Debug("order for user: ", zap.String("login", fmt.Sprint(currUser)), zap.Int64("order", number))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write(mJSON)
 	}
 }
 
+// HandlerGetOrderEvents streams changes of user's orders as server-sent events, events missed
+// since Last-Event-ID are sent first
+func (h *Handler) HandlerGetOrderEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			h.internalError(w, r, fmt.Errorf("streaming is not supported by %T", w))
+			return
+		}
+
+		var lastID int64
+		if v := r.Header.Get("Last-Event-ID"); v != "" {
+			lastID, err = strconv.ParseInt(v, 10, 64)
+		} else if v := r.URL.Query().Get("last_event_id"); v != "" {
+			lastID, err = strconv.ParseInt(v, 10, 64)
+		}
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("wrong last event id: %s", err))
+			return
+		}
+
+		// subscribe before reading missed events so that nothing is lost in between
+		stream, unsubscribe := h.events.Subscribe(currUser)
+		defer unsubscribe()
+
+		missed, err := h.db.SelectOrderEvents(h.spanCtx(r), currUser, lastID)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Debug("order events for user: ", zap.String("login", fmt.Sprint(currUser)), zap.Int64("last_event_id", lastID))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		write := func(ev models.OrderEvent) bool {
+			if ev.ID <= lastID {
+				return true
+			}
+			data, err := json.Marshal(&ev)
+			if err != nil {
+				h.logger.Error("could not prepare order event", zap.Error(err))
+				return true
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: order\ndata: %s\n\n", ev.ID, data); err != nil {
+				return false
+			}
+			lastID = ev.ID
+			return true
+		}
+		// ids of events of the user go one by one in the order of commits, notifications of other instances
+		// may come later than local ones though, so the events in between are read from the db
+		send := func(ev models.OrderEvent) bool {
+			if ev.ID <= lastID+1 {
+				return write(ev)
+			}
+			missed, err := h.db.SelectOrderEvents(h.spanCtx(r), currUser, lastID)
+			if err != nil {
+				h.logger.Error("could not read missed order events", zap.Error(err))
+				return false
+			}
+			for _, m := range missed {
+				if !write(m) {
+					return false
+				}
+			}
+			return write(ev)
+		}
+
+		for _, ev := range missed {
+			if !write(ev) {
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case ev, ok := <-stream:
+				if !ok || !send(ev) {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-h.ctx.Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
 // HandlerGetBalance get current balance and sum all withdrawals
 func (h *Handler) HandlerGetBalance() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -210,19 +474,19 @@ func (h *Handler) HandlerGetBalance() http.HandlerFunc {
 
 		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("401 - could not parse user id from token: %s", err), http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
 		}
 
-		balance, err := h.db.SelectBalance(h.ctx, currUser)
+		balance, err := h.db.SelectBalance(h.spanCtx(r), currUser)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+			h.internalError(w, r, err)
 			return
 		}
 
 		mJSON, err := json.Marshal(balance)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - could not prepare data for return: %s", err), http.StatusBadRequest)
+			h.internalError(w, r, err)
 			return
 		}
 
@@ -241,7 +505,7 @@ func (h *Handler) HandlerPostWithdraw() http.HandlerFunc {
 
 		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("401 - could not parse user id from token: %s", err), http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
 		}
 
@@ -250,36 +514,28 @@ func (h *Handler) HandlerPostWithdraw() http.HandlerFunc {
 		err = decoder.Decode(&o)
 
 		if err != nil && strings.Contains(err.Error(), "valid") {
-			http.Error(w, fmt.Sprintf("422 - internal server error: %s", err), http.StatusUnprocessableEntity)
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidOrderNumber, err.Error())
 			return
 
 		} else if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("json cannot be decoded: %s", err))
 			return
 		}
 
-		balance, err := h.db.SelectBalance(h.ctx, currUser)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+		err = h.svc.Withdraw(h.withMeta(r), currUser, o)
+		if errors.Is(err, app.ErrInsufficientFunds) {
+			writeProblem(w, r, http.StatusPaymentRequired, CodeInsufficientFunds, "current balance is not enough")
 			return
-		}
-
-		if balance.Current < o.Amount {
-			http.Error(w, fmt.Sprintf("402 - currenct balance is not enough: %s", err), http.StatusPaymentRequired)
+		} else if errors.Is(err, storage.ErrOrderExists) || errors.Is(err, storage.ErrOrderConflict) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeOrderNumberUsed, "order number was already used")
 			return
-		}
-
-		order := models.Order{ID: o.ID, Amount: -o.Amount, UserID: currUser, Status: "PROCESSED", Type: "withdraw"}
-		err = h.db.InsertOrder(h.ctx, order)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+		} else if err != nil {
+			h.internalError(w, r, err)
 			return
 		}
 
 		h.logger.Debug("withdraw succesfull for user: ", zap.String("login", fmt.Sprint(currUser)))
-		w.Header().Set("application-type", "text/plain")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"ok}`))
+		writeOK(w, http.StatusOK)
 	}
 }
 
@@ -291,23 +547,22 @@ func (h *Handler) HandlerGetWithdrawals() http.HandlerFunc {
 
 		currUser, err := app.UserIDFromContext(r.Context())
 		if err != nil {
-			http.Error(w, fmt.Sprintf("401 - could not parse user id from token: %s", err), http.StatusUnauthorized)
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
 			return
 		}
 
-		orders, err := h.db.SelectAllWithdrawals(h.ctx, currUser)
+		orders, err := h.db.SelectAllWithdrawals(h.spanCtx(r), currUser)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - internal server error: %s", err), http.StatusBadRequest)
+			h.internalError(w, r, err)
 			return
 		} else if len(*orders) == 0 {
 			w.WriteHeader(http.StatusNoContent)
-			w.Write([]byte(`{"status":"ok}`))
 			return
 		}
 
 		mJSON, err := json.Marshal(orders)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("500 - could not prepare data for return: %s", err), http.StatusBadRequest)
+			h.internalError(w, r, err)
 			return
 		}
 
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// checkTimeout limits every readiness check, probes of orchestrators have short timeouts
+const checkTimeout = 3 * time.Second
+
+// readyTTL is how long results of the checks are reused, so that frequent probes do not make a request
+// to the db and the accrual system every time
+const readyTTL = 5 * time.Second
+
+// Check tells whether a dependency of the service works, checks are run by /readyz
+type Check struct {
+	Name string
+	// Optional checks are reported but do not make the service unready
+	Optional bool
+	Run      func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of one check, status is "ok", "fail" or "warn" for failed optional checks.
+// Errors are logged rather than answered as they tell about the internals.
+type CheckResult struct {
+	Status string `json:"status"`
+}
+
+// Health is the answer of /readyz
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// readiness keeps the last results of the checks
+type readiness struct {
+	mu      sync.Mutex
+	checked time.Time
+	health  Health
+}
+
+// HandlerHealthz tells that the process is alive and serves requests, dependencies are not checked
+// so that an outage of the db does not make the orchestrator restart every instance
+func (h *Handler) HandlerHealthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeOK(w, http.StatusOK)
+	}
+}
+
+// HandlerReadyz answers 503 when any of the required checks fails, results are reused for readyTTL
+func (h *Handler) HandlerReadyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := h.readiness()
+
+		status := http.StatusOK
+		if health.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+// readiness runs all checks at once unless they were run recently, concurrent probes wait for the same run.
+// Checks are not bound to the request, its cancellation would be remembered as a failure.
+func (h *Handler) readiness() Health {
+	h.ready.mu.Lock()
+	defer h.ready.mu.Unlock()
+	if !h.ready.checked.IsZero() && time.Since(h.ready.checked) < readyTTL {
+		return h.ready.health
+	}
+
+	health := Health{Status: "ok", Checks: make(map[string]CheckResult, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(h.ctx, checkTimeout)
+			defer cancel()
+
+			res := CheckResult{Status: "ok"}
+			if err := c.Run(ctx); err != nil {
+				res.Status = "fail"
+				if c.Optional {
+					res.Status = "warn"
+				}
+				h.logger.Warn("readiness check failed", zap.String("check", c.Name), zap.Bool("optional", c.Optional), zap.Error(err))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			health.Checks[c.Name] = res
+			if res.Status == "fail" {
+				health.Status = "fail"
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	h.ready.health, h.ready.checked = health, time.Now()
+	return health
+}
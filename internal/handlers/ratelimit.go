@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/ratelimit"
+	"go.uber.org/zap"
+)
+
+// rateLimit takes a token from the bucket of the route group for every request. Clients with valid jwt are
+// limited per user, others per IP. When a request passes several groups, headers of the group with the
+// least remaining requests are left in the response. Limits are looked up on every request, as they are reloaded.
+func (h *Handler) rateLimit(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if h.rateLimiter == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, ok := h.rateLimiter.Limit(group)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := group + ":ip:" + requestMeta(r).IP
+			if userID, err := app.UserIDFromContext(r.Context()); err == nil {
+				key = group + ":user:" + strconv.FormatInt(userID, 10)
+			}
+
+			res, err := h.rateLimiter.Allow(r.Context(), key, limit)
+			if err != nil {
+				// the API stays available when the store is down
+				h.logger.Error("rate limit check failed", zap.Error(err), zap.String("group", group))
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			setRateLimitHeaders(w, res, limit)
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(res.RetryAfter)))
+				writeProblem(w, r, http.StatusTooManyRequests, CodeTooManyRequests, "rate limit exceeded, try again later")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setRateLimitHeaders reports the bucket in RateLimit-* headers unless an earlier group has less requests left
+func setRateLimitHeaders(w http.ResponseWriter, res ratelimit.Result, limit ratelimit.Limit) {
+	if prev, err := strconv.Atoi(w.Header().Get("RateLimit-Remaining")); err == nil && prev <= res.Remaining {
+		return
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(res.Reset)))
+	w.Header().Set("RateLimit-Policy", strconv.Itoa(limit.Requests)+";w="+strconv.Itoa(seconds(limit.Per)))
+}
+
+// seconds rounds the duration up for headers which take whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// WithTrustedProxies sets proxies in front of the service, the client IP is taken from their headers
+func WithTrustedProxies(nets []*net.IPNet) Option {
+	return func(h *Handler) {
+		h.trustedProxies = nets
+	}
+}
+
+// realIP replaces the address of the peer with the client IP given by a trusted proxy. Headers of other peers
+// are ignored, otherwise any client could pick a new IP for every request to bypass limits and forge audit records
+func (h *Handler) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		if err == nil && h.trusted(net.ParseIP(host)) {
+			if ip := h.forwardedIP(r); ip != nil {
+				r.RemoteAddr = net.JoinHostPort(ip.String(), port)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedIP is the rightmost address of X-Forwarded-For which is not a trusted proxy, the addresses to the left
+// of it are set by the client. X-Real-IP is used when there is no X-Forwarded-For.
+func (h *Handler) forwardedIP(r *http.Request) net.IP {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		var ip net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			if ip = net.ParseIP(strings.TrimSpace(hops[i])); ip == nil {
+				return nil
+			}
+			if !h.trusted(ip) {
+				return ip
+			}
+		}
+		// the whole chain is trusted, the leftmost proxy is the client then
+		return ip
+	}
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+func (h *Handler) trusted(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,41 +2,190 @@ package handlers
 
 import (
 	"context"
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/events"
+	"github.com/GoSeoTaxi/t1/internal/metrics"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/openapi"
+	"github.com/GoSeoTaxi/t1/internal/ratelimit"
 	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/GoSeoTaxi/t1/internal/throttle"
+	"github.com/GoSeoTaxi/t1/internal/tracing"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/jwtauth/v5"
 	"go.uber.org/zap"
+	"net/http"
 )
 
+// Option changes optional settings of the handlers
+type Option func(*Handler)
+
+// WithBatchLimit sets max amount of orders accepted in one batch upload
+func WithBatchLimit(limit int) Option {
+	return func(h *Handler) {
+		if limit > 0 {
+			h.batchLimit = limit
+		}
+	}
+}
+
+// WithEvents sets broker which delivers order events to the event stream
+func WithEvents(b *events.Broker) Option {
+	return func(h *Handler) {
+		h.events = b
+	}
+}
+
+// WithLoginThrottle slows down password guessing, gRPC API has to get the same limiter
+func WithLoginThrottle(l *throttle.Limiter) Option {
+	return func(h *Handler) {
+		h.throttle = l
+	}
+}
+
+// WithRateLimit limits requests of every client per route group
+func WithRateLimit(l *ratelimit.Limiter) Option {
+	return func(h *Handler) {
+		h.rateLimiter = l
+	}
+}
+
+// WithReadinessChecks sets dependencies checked by /readyz
+func WithReadinessChecks(checks ...Check) Option {
+	return func(h *Handler) {
+		h.checks = append(h.checks, checks...)
+	}
+}
+
+// WithResponseValidation checks every response against OpenAPI specification and reports mismatches,
+// it is used by tests to catch drift between handlers and the contract
+func WithResponseValidation(report func(r *http.Request, err error)) Option {
+	return func(h *Handler) {
+		h.reportResponse = report
+	}
+}
+
 // BonusRouter arranges the whole API endpoints and their correponding handlers
-func BonusRouter(ctx context.Context, db storage.DBinterface, secret string, logger *zap.Logger) chi.Router {
+func BonusRouter(ctx context.Context, db storage.DBinterface, tokenAuth *app.TokenAuth, logger *zap.Logger, opts ...Option) chi.Router {
 
 	r := chi.NewRouter()
 	mh := NewHandler(ctx, db, logger)
-	tokenAuth := jwtauth.New("HS256", []byte(secret), nil)
+	for _, opt := range opts {
+		opt(&mh)
+	}
+	mh.svc = app.NewService(db, tokenAuth, app.WithLoginThrottle(mh.throttle))
+	spec, err := openapi.NewValidator()
+	if err != nil {
+		logger.Fatal("OpenAPI specification is broken", zap.Error(err))
+	}
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(mh.realIP)
+	r.Use(tracing.HTTP)
+	r.Use(metrics.HTTP)
+	r.Use(tokenAuth.Verifier)
+	r.Use(mh.accessLog)
 	r.Use(middleware.Recoverer)
-	r.Use(jwtauth.Verifier(tokenAuth))
+	if mh.reportResponse != nil {
+		r.Use(spec.Responses(mh.reportResponse))
+	}
+	r.Use(spec.Requests(func(w http.ResponseWriter, r *http.Request, err error) {
+		writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+	}))
+	r.Use(mh.rateLimit(ratelimit.RouteAPI))
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "no such endpoint")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method is not allowed for the endpoint")
+	})
+
+	r.Get("/api/openapi.json", openapi.Handler)
 
 	r.Route("/api/user/", func(r chi.Router) {
-		r.Post("/register", Conveyor(mh.HandlerPostRegister(tokenAuth), unpackGZIP, checkForJSON))
-		r.Post("/login", Conveyor(mh.HandlerPostLogin(tokenAuth), unpackGZIP, checkForJSON))
-		r.With(jwtauth.Authenticator).Post("/orders", Conveyor(mh.HandlerPostOrders(), unpackGZIP, checkForText))
-		r.With(jwtauth.Authenticator).Get("/orders", Conveyor(mh.HandlerGetOrders(), unpackGZIP, packGZIP))
-		r.With(jwtauth.Authenticator).Route("/balance", func(r chi.Router) {
-			r.Get("/", Conveyor(mh.HandlerGetBalance(), unpackGZIP))
-			r.Post("/withdraw", Conveyor(mh.HandlerPostWithdraw(), unpackGZIP))
-			r.Get("/withdrawals", Conveyor(mh.HandlerGetWithdrawals(), unpackGZIP))
+		auth := r.With(mh.rateLimit(ratelimit.RouteAuth))
+		auth.Post("/register", Conveyor(mh.HandlerPostRegister(), unpackGZIP, checkForJSON))
+		auth.Post("/login", Conveyor(mh.HandlerPostLogin(), unpackGZIP, checkForJSON))
+
+		r.Group(func(r chi.Router) {
+			r.Use(authenticator, mh.activeUser)
+
+			orders, ordersWrite := r.With(requirePermission(models.PermOrdersRead)), r.With(requirePermission(models.PermOrdersWrite),
+				mh.rateLimit(ratelimit.RouteOrdersUpload))
+			ordersWrite.Post("/orders", Conveyor(mh.HandlerPostOrders(), unpackGZIP, checkForText))
+			ordersWrite.Post("/orders/batch", Conveyor(mh.HandlerPostOrdersBatch(), unpackGZIP, packGZIP))
+			orders.Get("/orders", Conveyor(mh.HandlerGetOrders(), unpackGZIP, packGZIP))
+			orders.Get("/orders/events", Conveyor(mh.HandlerGetOrderEvents(), unpackGZIP))
+			orders.Get("/orders/{number}", Conveyor(mh.HandlerGetOrder(), unpackGZIP, packGZIP))
+
+			balance, withdraw := requirePermission(models.PermBalanceRead), requirePermission(models.PermWithdraw)
+			r.Route("/balance", func(r chi.Router) {
+				r.With(balance).Get("/", Conveyor(mh.HandlerGetBalance(), unpackGZIP))
+				r.With(withdraw).Post("/withdraw", Conveyor(mh.HandlerPostWithdraw(), unpackGZIP))
+				r.With(balance).Get("/withdrawals", Conveyor(mh.HandlerGetWithdrawals(), unpackGZIP))
+			})
+
+			r.With(withdraw).Post("/withdraw", Conveyor(mh.HandlerPostWithdraw(), unpackGZIP))
+			r.With(balance).Get("/withdrawals", Conveyor(mh.HandlerGetWithdrawals(), unpackGZIP))
+
+			r.With(requirePermission(models.PermWebhooks)).Route("/webhooks", func(r chi.Router) {
+				r.Post("/", Conveyor(mh.HandlerPostWebhook(), unpackGZIP, checkForJSON))
+				r.Get("/", Conveyor(mh.HandlerGetWebhooks(), unpackGZIP))
+				r.Delete("/{id}", Conveyor(mh.HandlerDeleteWebhook(), unpackGZIP))
+				r.Get("/{id}/deliveries", Conveyor(mh.HandlerGetWebhookDeliveries(), unpackGZIP))
+			})
 		})
+	})
+
+	// tools of staff, every change made here is written to the audit log
+	r.Route("/api/admin/", func(r chi.Router) {
+		r.Use(authenticator, mh.activeUser)
+
+		users := r.With(requirePermission(models.PermUsersRead))
+		users.Get("/users", Conveyor(mh.HandlerAdminSearchUsers(), unpackGZIP, packGZIP))
+		users.Get("/users/{id}", Conveyor(mh.HandlerAdminGetUser(), unpackGZIP))
+		users.Get("/users/{id}/orders", Conveyor(mh.HandlerAdminGetUserOrders(), unpackGZIP, packGZIP))
+		users.Get("/users/{id}/ledger", Conveyor(mh.HandlerAdminGetLedger(), unpackGZIP, packGZIP))
+
+		r.With(requirePermission(models.PermBalanceAdjust)).
+			Post("/users/{id}/adjustments", Conveyor(mh.HandlerAdminAdjustBalance(), unpackGZIP, checkForJSON))
+		block := r.With(requirePermission(models.PermUsersBlock))
+		block.Post("/users/{id}/block", Conveyor(mh.HandlerAdminSetBlocked(true), unpackGZIP, checkForJSON))
+		block.Post("/users/{id}/unblock", Conveyor(mh.HandlerAdminSetBlocked(false), unpackGZIP, checkForJSON))
+		block.Post("/lockouts/unlock", Conveyor(mh.HandlerAdminUnlockLogin(), unpackGZIP, checkForJSON))
+		r.With(requirePermission(models.PermRolesManage)).
+			Post("/users/{id}/role", Conveyor(mh.HandlerAdminSetRole(), unpackGZIP, checkForJSON))
+		r.With(requirePermission(models.PermOrdersRequeue)).
+			Post("/orders/{number}/requeue", Conveyor(mh.HandlerAdminRequeueOrder(), unpackGZIP, checkForJSON))
+		r.With(requirePermission(models.PermAuditRead)).
+			Get("/audit/export", Conveyor(mh.HandlerAdminExportAudit(), unpackGZIP, packGZIP))
+	})
 
-		r.With(jwtauth.Authenticator).Post("/withdraw", Conveyor(mh.HandlerPostWithdraw(), unpackGZIP))
-		r.With(jwtauth.Authenticator).Get("/withdrawals", Conveyor(mh.HandlerGetWithdrawals(), unpackGZIP))
+	return r
+}
+
+// OpsRouter serves only metrics and probes on the address of operations, they are not served with the APIs
+// so that clients can't read figures of the business or make the instance check its dependencies
+func OpsRouter(ctx context.Context, db storage.DBinterface, logger *zap.Logger, opts ...Option) chi.Router {
+	r := chi.NewRouter()
+	mh := NewHandler(ctx, db, logger)
+	for _, opt := range opts {
+		opt(&mh)
+	}
+
+	r.Use(middleware.RequestID)
+	r.Use(mh.realIP)
+	r.Use(metrics.HTTP)
+	r.Use(mh.accessLog)
+	r.Use(middleware.Recoverer)
 
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, r, http.StatusNotFound, CodeNotFound, "no such endpoint")
 	})
+	r.Method(http.MethodGet, "/metrics", metrics.Handler())
+	r.Get("/healthz", mh.HandlerHealthz())
+	r.Get("/readyz", mh.HandlerReadyz())
 
 	return r
 }
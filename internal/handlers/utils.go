@@ -2,9 +2,14 @@ package handlers
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/go-chi/jwtauth/v5"
 )
 
 type Middleware func(http.Handler) http.HandlerFunc
@@ -22,7 +27,7 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 func checkForJSON(next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Type") != "application/json" {
-			http.Error(w, "400 - This endpoint accepts only jsons", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeWrongContentType, "this endpoint accepts only json")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -33,7 +38,7 @@ func checkForJSON(next http.Handler) http.HandlerFunc {
 func checkForText(next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Type") != "text/plain" {
-			http.Error(w, "400 - This endpoint accepts only plain text", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeWrongContentType, "this endpoint accepts only plain text")
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -44,7 +49,7 @@ func checkForText(next http.Handler) http.HandlerFunc {
 func unpackGZIP(next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Encoding") != "gzip" && r.Header.Get("Content-Encoding") != "" {
-			http.Error(w, "400 - Only gzip encoding is allowed", http.StatusBadRequest)
+			writeProblem(w, r, http.StatusBadRequest, CodeWrongEncoding, "only gzip encoding is allowed")
 			return
 		} else if r.Header.Get("Content-Encoding") != "gzip" {
 			next.ServeHTTP(w, r)
@@ -53,7 +58,7 @@ func unpackGZIP(next http.Handler) http.HandlerFunc {
 
 		rw, err := gzip.NewReader(r.Body)
 		if err != nil {
-			io.WriteString(w, err.Error())
+			writeProblem(w, r, http.StatusBadRequest, CodeWrongEncoding, fmt.Sprintf("body is not valid gzip: %s", err))
 			return
 		}
 		r.Body = rw
@@ -71,7 +76,7 @@ func packGZIP(next http.Handler) http.HandlerFunc {
 
 		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 		if err != nil {
-			io.WriteString(w, err.Error())
+			writeProblem(w, r, http.StatusInternalServerError, CodeInternal, "internal server error")
 			return
 		}
 		defer gz.Close()
@@ -81,6 +86,29 @@ func packGZIP(next http.Handler) http.HandlerFunc {
 	})
 }
 
+// setNextCursor tells client where the next page starts both as a Link header and as a bare cursor
+func setNextCursor(w http.ResponseWriter, r *http.Request, c models.OrderCursor) {
+	cursor := c.Encode()
+	q := r.URL.Query()
+	q.Set("cursor", cursor)
+	next := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	w.Header().Set("X-Next-Cursor", cursor)
+}
+
+// authenticator rejects requests without valid jwt, it replaces jwtauth.Authenticator to reply with problem details
+func authenticator(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, err := jwtauth.FromContext(r.Context())
+		if err != nil || token == nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Conveyor allows to pack middlware one after another
 func Conveyor(h http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
 	for _, middleware := range middlewares {
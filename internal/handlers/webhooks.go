@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// HandlerPostWebhook subscribes user's url to events, secret is generated if not given
+// and is returned only in this response
+func (h *Handler) HandlerPostWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		var hook models.Webhook
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("webhook json cannot be decoded: %s", err))
+			return
+		}
+		if err := hook.Validate(); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidWebhook, err.Error())
+			return
+		}
+		if err := app.CheckWebhookURL(h.spanCtx(r), hook.URL); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, CodeInvalidWebhook, err.Error())
+			return
+		}
+
+		if hook.Secret == "" {
+			if hook.Secret, err = app.GenerateSecret(); err != nil {
+				h.internalError(w, r, err)
+				return
+			}
+		}
+		hook.UserID = currUser
+
+		if err := h.db.CreateWebhook(h.spanCtx(r), &hook); err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		mJSON, err := json.Marshal(hook)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Debug("webhook created for user: ", zap.String("login", fmt.Sprint(currUser)), zap.Int64("webhook", hook.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(mJSON)
+	}
+}
+
+// HandlerGetWebhooks returns all webhooks of the user without secrets
+func (h *Handler) HandlerGetWebhooks() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		hooks, err := h.db.SelectWebhooks(h.spanCtx(r), currUser)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if len(hooks) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		mJSON, err := json.Marshal(hooks)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(mJSON)
+	}
+}
+
+// HandlerDeleteWebhook removes user's webhook, messages which were not yet delivered are dropped
+func (h *Handler) HandlerDeleteWebhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("wrong webhook id: %s", err))
+			return
+		}
+
+		err = h.db.DeleteWebhook(h.spanCtx(r), currUser, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		h.logger.Debug("webhook deleted for user: ", zap.String("login", fmt.Sprint(currUser)), zap.Int64("webhook", id))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandlerGetWebhookDeliveries returns last delivery attempts of user's webhook
+func (h *Handler) HandlerGetWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		currUser, err := app.UserIDFromContext(r.Context())
+		if err != nil {
+			writeProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "user is not authenticated")
+			return
+		}
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("wrong webhook id: %s", err))
+			return
+		}
+
+		deliveries, err := h.db.SelectWebhookDeliveries(h.spanCtx(r), currUser, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			writeProblem(w, r, http.StatusNotFound, CodeWebhookNotFound, "webhook not found")
+			return
+		} else if err != nil {
+			h.internalError(w, r, err)
+			return
+		} else if len(deliveries) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		mJSON, err := json.Marshal(deliveries)
+		if err != nil {
+			h.internalError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(mJSON)
+	}
+}
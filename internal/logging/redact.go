@@ -0,0 +1,105 @@
+// Package logging keeps secrets out of logs and sets how often repeated entries are written
+package logging
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces values of sensitive fields
+const Redacted = "[REDACTED]"
+
+// sensitive are keys of fields and query parameters whose values never get to logs
+var sensitive = []string{"password", "token", "jwt", "secret", "authorization", "cookie", "key"}
+
+// IsSensitive tells whether a field or parameter with the key holds a secret, keys are matched by substring,
+// so that "access_token" or "new_password" are caught as well
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitive {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactQuery encodes query parameters with values of sensitive ones replaced
+func RedactQuery(q url.Values) string {
+	for k, vs := range q {
+		if IsSensitive(k) {
+			for i := range vs {
+				vs[i] = Redacted
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// Redact wraps the core so that values of sensitive fields are replaced before they are encoded
+func Redact(core zapcore.Core) zapcore.Core {
+	return redactCore{core}
+}
+
+type redactCore struct {
+	zapcore.Core
+}
+
+func (c redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactCore{c.Core.With(redact(fields))}
+}
+
+func (c redactCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
+
+func (c redactCore) Write(e zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(e, redact(fields))
+}
+
+func redact(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for i, f := range fields {
+		if !IsSensitive(f.Key) {
+			continue
+		}
+		if out == nil {
+			// fields of the caller are not changed
+			out = append([]zapcore.Field(nil), fields...)
+		}
+		out[i] = zap.String(f.Key, Redacted)
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// ParseSampling reads sampling as "initial/thereafter": every second the first initial entries with the same
+// level and message are written, then every thereafter-th of them. "off" turns sampling off.
+func ParseSampling(s string) (*zap.SamplingConfig, error) {
+	if s == "" || s == "off" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("sampling %q is not initial/thereafter", s)
+	}
+	initial, err := strconv.Atoi(parts[0])
+	if err != nil || initial < 1 {
+		return nil, fmt.Errorf("wrong initial of sampling %q", s)
+	}
+	thereafter, err := strconv.Atoi(parts[1])
+	if err != nil || thereafter < 1 {
+		return nil, fmt.Errorf("wrong thereafter of sampling %q", s)
+	}
+	return &zap.SamplingConfig{Initial: initial, Thereafter: thereafter}, nil
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestParseSampling(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *zap.SamplingConfig
+		wantErr bool
+	}{
+		{in: "100/100", want: &zap.SamplingConfig{Initial: 100, Thereafter: 100}},
+		{in: "10/1000", want: &zap.SamplingConfig{Initial: 10, Thereafter: 1000}},
+		{in: "off"},
+		{in: ""},
+		{in: "100", wantErr: true},
+		{in: "0/100", wantErr: true},
+		{in: "100/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSampling(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
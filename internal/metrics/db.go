@@ -0,0 +1,109 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// statsTTL is how long figures of the db are reused, counting the queue and summing the ledger scan
+// the table of orders, so they are not run on every scrape
+const statsTTL = 30 * time.Second
+
+// StatsSource is the part of the db read by the collector
+type StatsSource interface {
+	SelectStats(ctx context.Context) (models.Stats, error)
+	PoolStat() *pgxpool.Stat
+}
+
+// DBCollector reads pool statistics when metrics are scraped, the queue of orders and ledger totals
+// are read at most once per statsTTL
+type DBCollector struct {
+	ctx    context.Context
+	db     StatsSource
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	stats   *models.Stats
+
+	pendingOrders *prometheus.Desc
+	ledger        *prometheus.Desc
+	poolConns     *prometheus.Desc
+	poolMaxConns  *prometheus.Desc
+	poolAcquires  *prometheus.Desc
+	poolWait      *prometheus.Desc
+}
+
+func NewDBCollector(ctx context.Context, db StatsSource, logger *zap.Logger) *DBCollector {
+	desc := func(name string, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+	return &DBCollector{
+		ctx:           ctx,
+		db:            db,
+		logger:        logger,
+		pendingOrders: desc("orders_pending", "Orders waiting for the accrual system."),
+		ledger:        desc("ledger_total", "Sum of processed bonus changes by type, in bonuses.", "type"),
+		poolConns:     desc("db_pool_connections", "Connections of the pool by state.", "state"),
+		poolMaxConns:  desc("db_pool_max_connections", "Max size of the pool."),
+		poolAcquires:  desc("db_pool_acquires_total", "Connections acquired from the pool."),
+		poolWait:      desc("db_pool_acquire_wait_seconds_total", "Time spent waiting for a connection of the pool."),
+	}
+}
+
+func (c *DBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.pendingOrders
+	ch <- c.ledger
+	ch <- c.poolConns
+	ch <- c.poolMaxConns
+	ch <- c.poolAcquires
+	ch <- c.poolWait
+}
+
+// Collect skips figures of the db when it did not answer, pool statistics are always there
+func (c *DBCollector) Collect(ch chan<- prometheus.Metric) {
+	if s := c.db.PoolStat(); s != nil {
+		ch <- prometheus.MustNewConstMetric(c.poolConns, prometheus.GaugeValue, float64(s.AcquiredConns()), "acquired")
+		ch <- prometheus.MustNewConstMetric(c.poolConns, prometheus.GaugeValue, float64(s.IdleConns()), "idle")
+		ch <- prometheus.MustNewConstMetric(c.poolConns, prometheus.GaugeValue, float64(s.ConstructingConns()), "constructing")
+		ch <- prometheus.MustNewConstMetric(c.poolMaxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+		ch <- prometheus.MustNewConstMetric(c.poolAcquires, prometheus.CounterValue, float64(s.AcquireCount()))
+		ch <- prometheus.MustNewConstMetric(c.poolWait, prometheus.CounterValue, s.AcquireDuration().Seconds())
+	}
+
+	stats := c.cachedStats()
+	if stats == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.pendingOrders, prometheus.GaugeValue, float64(stats.PendingOrders))
+	for kind, sum := range stats.Ledger {
+		ch <- prometheus.MustNewConstMetric(c.ledger, prometheus.GaugeValue, float64(sum)/100, kind)
+	}
+}
+
+// cachedStats reads figures of the db unless they were read within statsTTL, a failure is remembered
+// as well so that a struggling db is not queried on every scrape. Nil is returned when they are unknown.
+func (c *DBCollector) cachedStats() *models.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < statsTTL {
+		return c.stats
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 5*time.Second)
+	defer cancel()
+	c.checked, c.stats = time.Now(), nil
+	stats, err := c.db.SelectStats(ctx)
+	if err != nil {
+		c.logger.Error("collecting db metrics failed", zap.Error(err))
+		return nil
+	}
+	c.stats = &stats
+	return c.stats
+}
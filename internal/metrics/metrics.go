@@ -0,0 +1,65 @@
+// Package metrics exposes Prometheus metrics of the HTTP API, the accrual worker and the database
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/GoSeoTaxi/t1/internal/observe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gophermart"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time of handling HTTP requests by route pattern and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// AccrualRequests counts requests to the accrual system by status code, "error" when there is no response
+	AccrualRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_requests_total",
+		Help:      "Requests to the accrual system by status code.",
+	}, []string{"code"})
+
+	// WorkerBatchDuration is the time the worker spends on one batch of orders
+	WorkerBatchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "worker_batch_duration_seconds",
+		Help:      "Time of checking one batch of orders in the accrual system.",
+		Buckets:   []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	})
+
+	// WorkerBatchOrders counts orders checked by the worker
+	WorkerBatchOrders = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "worker_orders_checked_total",
+		Help:      "Orders checked in the accrual system.",
+	})
+)
+
+// Handler serves metrics of the default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HTTP measures requests, route is the chi pattern so that numbers of orders and ids do not make new series
+func HTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := observe.Serve(next, w, r)
+		httpRequests.WithLabelValues(res.Route, r.Method, strconv.Itoa(res.Status)).Inc()
+		httpDuration.WithLabelValues(res.Route, r.Method).Observe(res.Duration.Seconds())
+	})
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// UserInfo is the account of a user as support staff see it
+type UserInfo struct {
+	ID        int64
+	Login     string
+	Role      string
+	BlockedAt time.Time
+	CreatedAt time.Time
+	Balance   int64
+}
+
+func (u *UserInfo) MarshalJSON() ([]byte, error) {
+	type newUser struct {
+		ID        int64   `json:"id"`
+		Login     string  `json:"login"`
+		Role      string  `json:"role"`
+		Blocked   bool    `json:"blocked"`
+		BlockedAt string  `json:"blocked_at,omitempty"`
+		CreatedAt string  `json:"created_at"`
+		Balance   float64 `json:"balance"`
+	}
+
+	nu := newUser{
+		ID:        u.ID,
+		Login:     u.Login,
+		Role:      u.Role,
+		Blocked:   !u.BlockedAt.IsZero(),
+		CreatedAt: u.CreatedAt.Format(time.RFC3339),
+		Balance:   float64(u.Balance) / 100,
+	}
+	if !u.BlockedAt.IsZero() {
+		nu.BlockedAt = u.BlockedAt.Format(time.RFC3339)
+	}
+
+	return json.Marshal(nu)
+}
+
+// LedgerEntry is one change of user's bonuses, Balance is the sum of processed changes up to this one
+type LedgerEntry struct {
+	ID      int64
+	Order   int64
+	Type    string
+	Status  string
+	Change  int64
+	Balance int64
+	Reason  string
+	Date    time.Time
+}
+
+func (e *LedgerEntry) MarshalJSON() ([]byte, error) {
+	type newEntry struct {
+		ID      int64   `json:"id"`
+		Order   string  `json:"order,omitempty"`
+		Type    string  `json:"type"`
+		Status  string  `json:"status"`
+		Change  float64 `json:"change"`
+		Balance float64 `json:"balance"`
+		Reason  string  `json:"reason,omitempty"`
+		Date    string  `json:"date"`
+	}
+
+	ne := newEntry{
+		ID:      e.ID,
+		Type:    e.Type,
+		Status:  e.Status,
+		Change:  float64(e.Change) / 100,
+		Balance: float64(e.Balance) / 100,
+		Reason:  e.Reason,
+		Date:    e.Date.Format(time.RFC3339),
+	}
+	if e.Order != 0 {
+		ne.Order = fmt.Sprint(e.Order)
+	}
+
+	return json.Marshal(ne)
+}
+
+// Adjustment is a manual credit (positive amount) or debit (negative amount) of user's bonuses
+type Adjustment struct {
+	UserID int64
+	Amount int64
+	Reason string
+}
+
+func (a *Adjustment) UnmarshalJSON(data []byte) error {
+	var na struct {
+		Amount float64 `json:"amount"`
+		Reason string  `json:"reason"`
+	}
+
+	if err := json.Unmarshal(data, &na); err != nil {
+		return err
+	}
+
+	a.Amount = int64(math.Round(na.Amount * 100))
+	a.Reason = na.Reason
+
+	return nil
+}
+
+// Actions written to the audit log
+const (
+	AuditUserRegistered  = "user.registered"
+	AuditLoginSucceeded  = "user.logged_in"
+	AuditLoginFailed     = "user.login_failed"
+	AuditLoginLocked     = "user.login_locked"
+	AuditLoginUnlocked   = "user.login_unlocked"
+	AuditOrderUploaded   = "order.uploaded"
+	AuditWithdrawal      = "balance.withdrawn"
+	AuditBalanceAdjusted = "balance.adjusted"
+	AuditUserBlocked     = "user.blocked"
+	AuditUserUnblocked   = "user.unblocked"
+	AuditOrderRequeued   = "order.requeued"
+	AuditRoleChanged     = "user.role_changed"
+	AuditPasswordReset   = "user.password_reset"
+)
+
+// ActorSelf is the actor of the registration made by the new user, it is replaced with the id of the user
+// when the user is created
+const ActorSelf int64 = -1
+
+// AuditEvent records who did what with whom and from where, Before and After keep the values changed by the action.
+// ActorID is 0 when the actor is not known, e.g. for failed logins.
+type AuditEvent struct {
+	ID        int64
+	ActorID   int64
+	Action    string
+	Target    string
+	Reason    string
+	Before    json.RawMessage
+	After     json.RawMessage
+	IP        string
+	RequestID string
+	CreatedAt time.Time
+}
+
+func (e *AuditEvent) MarshalJSON() ([]byte, error) {
+	type newEvent struct {
+		ID        int64           `json:"id"`
+		ActorID   int64           `json:"actor_id,omitempty"`
+		Action    string          `json:"action"`
+		Target    string          `json:"target"`
+		Reason    string          `json:"reason,omitempty"`
+		Before    json.RawMessage `json:"before,omitempty"`
+		After     json.RawMessage `json:"after,omitempty"`
+		IP        string          `json:"ip,omitempty"`
+		RequestID string          `json:"request_id,omitempty"`
+		CreatedAt string          `json:"created_at"`
+	}
+
+	return json.Marshal(newEvent{
+		ID:        e.ID,
+		ActorID:   e.ActorID,
+		Action:    e.Action,
+		Target:    e.Target,
+		Reason:    e.Reason,
+		Before:    e.Before,
+		After:     e.After,
+		IP:        e.IP,
+		RequestID: e.RequestID,
+		CreatedAt: e.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+// AuditFilter selects events for export, zero fields are not applied
+type AuditFilter struct {
+	ActorID int64
+	Target  string
+	Action  string
+	From    time.Time
+	To      time.Time
+}
+
+// UserTarget, OrderTarget, LoginTarget and IPTarget name objects of audit events,
+// LoginTarget is used when the user is not known, e.g. for failed logins
+func UserTarget(id int64) string { return fmt.Sprintf("user:%d", id) }
+
+func OrderTarget(number int64) string { return fmt.Sprintf("order:%d", number) }
+
+func LoginTarget(login string) string { return "login:" + login }
+
+func IPTarget(ip string) string { return "ip:" + ip }
+
+// Stats are figures of the whole system exported as metrics
+type Stats struct {
+	PendingOrders int64
+	// Ledger is the sum of processed changes by their type
+	Ledger map[string]int64
+}
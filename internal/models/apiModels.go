@@ -2,6 +2,7 @@ package models
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -26,6 +27,90 @@ type Order struct {
 	Date   time.Time `json:"uploaded_at,omitempty"`
 	Type   string    `json:"type,omitempty"`
 	UserID int64     `json:"user_id,omitempty"`
+	Seq    int64     `json:"-"`
+	// CheckedAt is the time of the last request to accrual system about the order
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// OrderCursor points to the last order of a page, next page starts right after it
+type OrderCursor struct {
+	Date time.Time
+	Seq  int64
+}
+
+// OrderFilter describes which orders and in which order have to be selected
+type OrderFilter struct {
+	Statuses []string
+	Type     string
+	From     time.Time
+	To       time.Time
+	Desc     bool
+	Limit    int
+	After    *OrderCursor
+}
+
+// Encode packs cursor into an opaque url safe string
+func (c OrderCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.Date.UnixMicro(), c.Seq)))
+}
+
+// DecodeOrderCursor unpacks cursor produced by Encode
+func DecodeOrderCursor(s string) (*OrderCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("cursor is not valid")
+	}
+
+	var micro, seq int64
+	if _, err := fmt.Sscanf(string(b), "%d:%d", &micro, &seq); err != nil {
+		return nil, fmt.Errorf("cursor is not valid")
+	}
+
+	return &OrderCursor{Date: time.UnixMicro(micro), Seq: seq}, nil
+}
+
+// Results of an order upload in a batch
+const (
+	BatchAccepted  = "accepted"
+	BatchDuplicate = "duplicate"
+	BatchConflict  = "conflict"
+	BatchInvalid   = "invalid"
+)
+
+// BatchResult describes what happened to one order number from a batch upload
+type BatchResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
+}
+
+// OrderEvent tells that status or accrual of the user's order has changed
+type OrderEvent struct {
+	ID     int64     `json:"id"`
+	UserID int64     `json:"-"`
+	Order  int64     `json:"number"`
+	Status string    `json:"status"`
+	Amount int64     `json:"accrual"`
+	Date   time.Time `json:"changed_at"`
+}
+
+func (e *OrderEvent) MarshalJSON() ([]byte, error) {
+	type newEvent struct {
+		ID     int64   `json:"id"`
+		Order  string  `json:"number"`
+		Status string  `json:"status"`
+		Amount float64 `json:"accrual"`
+		Date   string  `json:"changed_at"`
+	}
+
+	ne := newEvent{
+		ID:     e.ID,
+		Order:  fmt.Sprint(e.Order),
+		Status: e.Status,
+		Amount: math.Abs(float64(e.Amount)) / 100,
+		Date:   e.Date.Format(time.RFC3339),
+	}
+
+	return json.Marshal(ne)
 }
 
 type AccrualOrder struct {
@@ -85,12 +170,17 @@ func (u *User) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
-	np := sha256.Sum256([]byte(u.Password))
-	u.Password = hex.EncodeToString((np[:]))
+	u.Password = HashPassword(u.Password)
 
 	return nil
 }
 
+// HashPassword makes the hash kept in the db instead of the password
+func HashPassword(password string) string {
+	np := sha256.Sum256([]byte(password))
+	return hex.EncodeToString((np[:]))
+}
+
 func (w *Withdrawal) UnmarshalJSON(data []byte) error {
 	type newU struct {
 		ID     string  `json:"order,omitempty"`
@@ -135,10 +225,11 @@ func (w *Withdrawal) MarshalJSON() ([]byte, error) {
 
 func (o *Order) MarshalJSON() ([]byte, error) {
 	type newOrder struct {
-		ID     string  `json:"number,omitempty"`
-		Status string  `json:"status"`
-		Amount float64 `json:"accrual"`
-		Date   string  `json:"uploaded_at,omitempty"`
+		ID        string  `json:"number,omitempty"`
+		Status    string  `json:"status"`
+		Amount    float64 `json:"accrual"`
+		Date      string  `json:"uploaded_at,omitempty"`
+		CheckedAt string  `json:"checked_at,omitempty"`
 	}
 
 	nb := newOrder{
@@ -147,16 +238,20 @@ func (o *Order) MarshalJSON() ([]byte, error) {
 		ID:     fmt.Sprint(o.ID),
 		Status: o.Status,
 	}
+	if !o.CheckedAt.IsZero() {
+		nb.CheckedAt = o.CheckedAt.Format(time.RFC3339)
+	}
 
 	return json.Marshal(nb)
 }
 
 func (o *Order) UnmarshalJSON(data []byte) error {
 	type newU struct {
-		ID     string    `json:"number,omitempty"`
-		Status string    `json:"status"`
-		Amount float64   `json:"accrual"`
-		Date   time.Time `json:"uploaded_at,omitempty"`
+		ID        string    `json:"number,omitempty"`
+		Status    string    `json:"status"`
+		Amount    float64   `json:"accrual"`
+		Date      time.Time `json:"uploaded_at,omitempty"`
+		CheckedAt time.Time `json:"checked_at,omitempty"`
 	}
 	nu := newU{}
 
@@ -177,6 +272,7 @@ func (o *Order) UnmarshalJSON(data []byte) error {
 	o.Amount = int64(nu.Amount * 100)
 	o.Date = nu.Date
 	o.Status = nu.Status
+	o.CheckedAt = nu.CheckedAt
 
 	return nil
 }
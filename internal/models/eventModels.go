@@ -0,0 +1,57 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Types of domain events
+const (
+	EventOrderAccepted  = "order.accepted"
+	EventOrderProcessed = "order.processed"
+	EventWithdrawalMade = "withdrawal.made"
+)
+
+// EventPayload is what happened to the order, it is sent as is to sinks and webhooks
+type EventPayload struct {
+	Event      string
+	UserID     int64
+	Order      int64
+	Status     string
+	Amount     int64
+	OccurredAt time.Time
+}
+
+func (p *EventPayload) MarshalJSON() ([]byte, error) {
+	type newPayload struct {
+		Event      string  `json:"event"`
+		UserID     int64   `json:"user_id"`
+		Order      string  `json:"order"`
+		Status     string  `json:"status"`
+		Amount     float64 `json:"amount"`
+		OccurredAt string  `json:"occurred_at"`
+	}
+
+	np := newPayload{
+		Event:      p.Event,
+		UserID:     p.UserID,
+		Order:      fmt.Sprint(p.Order),
+		Status:     p.Status,
+		Amount:     math.Abs(float64(p.Amount)) / 100,
+		OccurredAt: p.OccurredAt.Format(time.RFC3339),
+	}
+
+	return json.Marshal(np)
+}
+
+// DomainEvent is an event from the outbox, ID grows in the order events were commited
+type DomainEvent struct {
+	ID        int64           `json:"id"`
+	UserID    int64           `json:"user_id"`
+	Seq       int64           `json:"seq"`
+	Type      string          `json:"event"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
@@ -0,0 +1,77 @@
+package models
+
+// Roles of users, the role is stored in users table and is copied to jwt claims on login
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+	RolePartner = "partner"
+)
+
+// Permission is a right to call a group of routes
+type Permission string
+
+const (
+	PermOrdersRead    Permission = "orders:read"
+	PermOrdersWrite   Permission = "orders:write"
+	PermBalanceRead   Permission = "balance:read"
+	PermWithdraw      Permission = "balance:withdraw"
+	PermWebhooks      Permission = "webhooks:manage"
+	PermUsersRead     Permission = "users:read"
+	PermUsersBlock    Permission = "users:block"
+	PermBalanceAdjust Permission = "balance:adjust"
+	PermOrdersRequeue Permission = "orders:requeue"
+	PermRolesManage   Permission = "roles:manage"
+	PermAuditRead     Permission = "audit:read"
+)
+
+var customerPerms = []Permission{PermOrdersRead, PermOrdersWrite, PermBalanceRead, PermWithdraw, PermWebhooks}
+
+// rolePerms lists what each role may do, staff keep the rights of a customer for their own account.
+// Partners upload orders of their customers and follow them with webhooks, they have no bonuses to spend.
+var rolePerms = map[string][]Permission{
+	RoleUser:    customerPerms,
+	RolePartner: {PermOrdersRead, PermOrdersWrite, PermWebhooks},
+	RoleSupport: append([]Permission{PermUsersRead, PermUsersBlock, PermBalanceAdjust, PermOrdersRequeue}, customerPerms...),
+	RoleAdmin: append([]Permission{PermUsersRead, PermUsersBlock, PermBalanceAdjust, PermOrdersRequeue, PermRolesManage,
+		PermAuditRead}, customerPerms...),
+}
+
+// ValidRole checks that the role is known
+func ValidRole(role string) bool {
+	_, ok := rolePerms[role]
+	return ok
+}
+
+// RoleHas tells whether the role has all the permissions, unknown role has none
+func RoleHas(role string, perms ...Permission) bool {
+	for _, p := range perms {
+		found := false
+		for _, rp := range rolePerms[role] {
+			if rp == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// staffScope lists roles of accounts staff of the role may change, support does not touch other staff
+var staffScope = map[string][]string{
+	RoleSupport: {RoleUser, RolePartner},
+	RoleAdmin:   {RoleUser, RolePartner, RoleSupport, RoleAdmin},
+}
+
+// CanActOn tells whether staff with the actor role may change an account with the target role
+func CanActOn(actor string, target string) bool {
+	for _, r := range staffScope[actor] {
+		if r == target {
+			return true
+		}
+	}
+	return false
+}
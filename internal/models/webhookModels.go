@@ -0,0 +1,65 @@
+package models
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// WebhookEventTypes lists all event types which can be delivered with webhooks
+var WebhookEventTypes = []string{EventOrderAccepted, EventOrderProcessed, EventWithdrawalMade}
+
+// Webhook is user's subscription to events delivered to URL and signed with the secret
+type Webhook struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Validate checks that webhook can be saved
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url should be absolute http or https url")
+	}
+
+	if len(w.Events) == 0 {
+		return fmt.Errorf("at least one event type is required")
+	}
+	for _, e := range w.Events {
+		known := false
+		for _, t := range WebhookEventTypes {
+			known = known || e == t
+		}
+		if !known {
+			return fmt.Errorf("unknown event type: %s", e)
+		}
+	}
+
+	return nil
+}
+
+// WebhookMessage is an event from the outbox which has to be delivered to a webhook
+type WebhookMessage struct {
+	ID       int64
+	Event    string
+	Payload  []byte
+	URL      string
+	Secret   string
+	Attempts int
+}
+
+// WebhookDelivery is one attempt to deliver a message
+type WebhookDelivery struct {
+	ID         int64     `json:"id"`
+	MessageID  int64     `json:"message_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
@@ -0,0 +1,49 @@
+// Package observe tells middlewares of logs, metrics and traces how a request was served, so that all of them
+// name routes and count statuses the same way
+package observe
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Unmatched is the route of requests which did not match any route, their paths would make a series per path
+const Unmatched = "unmatched"
+
+// Result of serving a request
+type Result struct {
+	// Route is the chi pattern, Unmatched when no route matched
+	Route    string
+	Status   int
+	Size     int
+	Duration time.Duration
+}
+
+// Serve serves the request by next and tells how it was served, status is 200 when the handler
+// did not write a header
+func Serve(next http.Handler, w http.ResponseWriter, r *http.Request) Result {
+	start := time.Now()
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	next.ServeHTTP(ww, r)
+
+	res := Result{Route: Route(r), Status: ww.Status(), Size: ww.BytesWritten(), Duration: time.Since(start)}
+	if res.Route == "" {
+		res.Route = Unmatched
+	}
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	return res
+}
+
+// Route is the chi pattern matched by the request, it is empty until the request is routed or when it
+// matched nothing
+func Route(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		return rctx.RoutePattern()
+	}
+	return ""
+}
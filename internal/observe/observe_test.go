@@ -0,0 +1,34 @@
+package observe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+	var results []Result
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			results = append(results, Serve(next, w, r))
+		})
+	})
+	r.Get("/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	for _, path := range []string{"/orders/12345678903", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, Result{Route: "/orders/{number}", Status: http.StatusOK, Size: 2, Duration: results[0].Duration}, results[0],
+			"status is 200 when the header is not written")
+		assert.Equal(t, Unmatched, results[1].Route)
+		assert.Equal(t, http.StatusNotFound, results[1].Status)
+	}
+}
@@ -0,0 +1,176 @@
+// Package openapi holds OpenAPI specification of the HTTP API and middlewares which check
+// requests and responses against it
+package openapi
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"mime"
+	"net/http"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the specification document as it is served to clients
+func Spec() []byte {
+	return spec
+}
+
+// Load parses and validates the specification
+func Load() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err = doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Handler serves the specification
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(spec)
+}
+
+// Validator checks requests and responses of the operations described in the specification.
+// Requests to paths which are not in the specification are passed as is.
+type Validator struct {
+	doc    *openapi3.T
+	router routers.Router
+}
+
+// NewValidator loads the specification and prepares routing of requests to its operations
+func NewValidator() (*Validator, error) {
+	doc, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{doc: doc, router: router}, nil
+}
+
+// Doc returns the parsed specification
+func (v *Validator) Doc() *openapi3.T {
+	return v.doc
+}
+
+func (v *Validator) input(r *http.Request) *openapi3filter.RequestValidationInput {
+	route, params, err := v.router.FindRoute(r)
+	if err != nil {
+		return nil
+	}
+	return &openapi3filter.RequestValidationInput{
+		Request:    r,
+		PathParams: params,
+		Route:      route,
+		Options: &openapi3filter.Options{
+			// authentication is checked by the handlers, spec only documents it
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		},
+	}
+}
+
+// Requests checks parameters and bodies of incoming requests. Body is checked only when its
+// content type is declared for the operation and it is not compressed, other cases are left
+// to the handlers which answer with more specific errors.
+func (v *Validator) Requests(onError func(w http.ResponseWriter, r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			in := v.input(r)
+			if in == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Header.Get("Content-Encoding") != "" || !declaredBody(in.Route.Operation, r.Header.Get("Content-Type")) {
+				in.Options.ExcludeRequestBody = true
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), in); err != nil {
+				onError(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func declaredBody(op *openapi3.Operation, contentType string) bool {
+	if op.RequestBody == nil || op.RequestBody.Value == nil {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return op.RequestBody.Value.Content.Get(mt) != nil
+}
+
+// Responses checks status codes, headers and bodies of responses and reports mismatches
+// with the specification. Response is sent to the client anyway, the middleware is meant
+// for tests which fail when handlers drift away from the contract.
+func (v *Validator) Responses(report func(r *http.Request, err error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			in := v.input(r)
+			if in == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			ct, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+			in.Options.IncludeResponseStatus = true
+			in.Options.ExcludeResponseBody = w.Header().Get("Content-Encoding") != "" || ct == "text/event-stream" ||
+				ct == "application/x-ndjson"
+			if rec.body.Len() == 0 && w.Header().Get("Content-Type") == "" {
+				in.Options.ExcludeResponseBody = true
+			}
+			out := &openapi3filter.ResponseValidationInput{
+				RequestValidationInput: in,
+				Status:                 rec.status,
+				Header:                 w.Header(),
+				Options:                in.Options,
+			}
+			out.SetBodyBytes(rec.body.Bytes())
+			if err := openapi3filter.ValidateResponse(r.Context(), out); err != nil {
+				report(r, err)
+			}
+		})
+	}
+}
+
+// recorder passes response to the client keeping a copy of it
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *recorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
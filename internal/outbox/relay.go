@@ -0,0 +1,84 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"go.uber.org/zap"
+)
+
+// relayBatch is how many events are taken from the outbox at once
+const relayBatch = 100
+
+// Relay publishes events from the outbox to all sinks. Event is marked as published only when every sink
+// accepted it, so delivery is at least once. Events of a user are numbered under the lock of the user and come
+// from the outbox in the order of numbers; if an event fails, later events of the same user wait for the next
+// round, which keeps events of every user in order. Sinks may tell duplicates by the user and the number.
+type Relay struct {
+	ctx    context.Context
+	logger *zap.Logger
+	db     storage.DBinterface
+	sinks  []Sink
+}
+
+func NewRelay(ctx context.Context, logger *zap.Logger, db storage.DBinterface, sinks ...Sink) Relay {
+	return Relay{
+		ctx:    ctx,
+		logger: logger,
+		db:     db,
+		sinks:  sinks,
+	}
+}
+
+// Run acts as worker that publishes the outbox on every tick
+func (r *Relay) Run(t <-chan time.Time) {
+	for {
+		select {
+		case <-t:
+			for {
+				n, err := r.db.ProcessOutbox(r.ctx, relayBatch, r.publish)
+				if err != nil {
+					r.logger.Error("processing outbox failed", zap.Error(err))
+				}
+				// a full batch means there can be more events waiting
+				if err != nil || n < relayBatch {
+					break
+				}
+			}
+		case <-r.ctx.Done():
+			r.logger.Info("context canceled")
+			return
+		}
+	}
+}
+
+// publish sends events to sinks in order and returns ids of events accepted by all sinks
+func (r *Relay) publish(list []models.DomainEvent) []int64 {
+	var published []int64
+	blocked := make(map[int64]bool)
+
+	for _, ev := range list {
+		if blocked[ev.UserID] {
+			continue
+		}
+
+		ok := true
+		for _, s := range r.sinks {
+			if err := s.Publish(r.ctx, ev); err != nil {
+				r.logger.Error("publishing event failed", zap.String("sink", s.Name()), zap.Int64("event", ev.ID), zap.Error(err))
+				ok = false
+				break
+			}
+		}
+
+		if !ok {
+			blocked[ev.UserID] = true
+			continue
+		}
+		published = append(published, ev.ID)
+	}
+
+	return published
+}
@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type fakeSink struct {
+	failed    map[int64]bool
+	published []int64
+}
+
+func (s *fakeSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeSink) Publish(ctx context.Context, ev models.DomainEvent) error {
+	if s.failed[ev.ID] {
+		return fmt.Errorf("sink is down")
+	}
+	s.published = append(s.published, ev.ID)
+	return nil
+}
+
+func TestRelay_publish(t *testing.T) {
+	list := []models.DomainEvent{{ID: 1, UserID: 1}, {ID: 2, UserID: 2}, {ID: 3, UserID: 1}, {ID: 4, UserID: 2}, {ID: 5, UserID: 3}}
+	tests := []struct {
+		name      string
+		failed    map[int64]bool
+		published []int64
+	}{
+		{name: "all_published",
+			published: []int64{1, 2, 3, 4, 5},
+		},
+		{name: "user_waits_after_failure",
+			failed:    map[int64]bool{2: true},
+			published: []int64{1, 3, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := zap.NewDevelopment()
+			first := &fakeSink{}
+			second := &fakeSink{failed: tt.failed}
+			r := NewRelay(context.Background(), logger, nil, first, second)
+
+			assert.Equal(t, tt.published, r.publish(list))
+			assert.Equal(t, tt.published, second.published)
+		})
+	}
+}
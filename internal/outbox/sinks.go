@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/GoSeoTaxi/t1/internal/events"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+)
+
+// Sink is a destination domain events from the outbox are published to.
+// An event can be published more than once, so sinks should tolerate duplicates by event ID.
+type Sink interface {
+	Name() string
+	Publish(context.Context, models.DomainEvent) error
+}
+
+// BusSink publishes events to the in-process bus
+type BusSink struct {
+	bus *events.Bus
+}
+
+func NewBusSink(bus *events.Bus) *BusSink {
+	return &BusSink{bus: bus}
+}
+
+func (s *BusSink) Name() string {
+	return "bus"
+}
+
+func (s *BusSink) Publish(ctx context.Context, ev models.DomainEvent) error {
+	s.bus.Publish(ev)
+	return nil
+}
+
+// WebhookSink makes webhook messages for users subscribed to the event
+type WebhookSink struct {
+	db storage.DBinterface
+}
+
+func NewWebhookSink(db storage.DBinterface) *WebhookSink {
+	return &WebhookSink{db: db}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhooks"
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, ev models.DomainEvent) error {
+	return s.db.EnqueueWebhooks(ctx, ev)
+}
+
+// FileSink appends events to a file as newline delimited json
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open events file failed: %v", err)
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Publish writes event and syncs the file so that event is not lost once it is marked as published
+func (s *FileSink) Publish(ctx context.Context, ev models.DomainEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("prepare event failed: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write event failed: %v", err)
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,158 @@
+// Package ratelimit limits how often one client can call the API. Every client has a token bucket per route group,
+// each request takes a token and the bucket is refilled evenly over time.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the route groups which get their own buckets
+const (
+	// RouteAPI is every request to the API
+	RouteAPI = "api"
+	// RouteAuth is register and login, they are limited per IP as the client has no token yet
+	RouteAuth = "auth"
+	// RouteOrdersUpload is upload of orders, each of them makes requests to the accrual system
+	RouteOrdersUpload = "orders_upload"
+)
+
+// Limit is the size of the bucket and the time in which the empty bucket is full again
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// rate is how many tokens are added per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+// DefaultLimits are used for the route groups which are not set in the config
+var DefaultLimits = map[string]Limit{
+	RouteAPI:          {Requests: 300, Per: time.Minute},
+	RouteAuth:         {Requests: 20, Per: time.Minute},
+	RouteOrdersUpload: {Requests: 60, Per: time.Minute},
+}
+
+// ParseLimits reads limits like "api=300/1m,orders_upload=60/1m" over DefaultLimits
+func ParseLimits(s string) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(DefaultLimits))
+	for name, l := range DefaultLimits {
+		limits[name] = l
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("rate limit %q has no name", item)
+		}
+		name := parts[0]
+		if _, ok := DefaultLimits[name]; !ok {
+			return nil, fmt.Errorf("unknown route group %q", name)
+		}
+		value := strings.SplitN(parts[1], "/", 2)
+		if len(value) != 2 {
+			return nil, fmt.Errorf("rate limit %q is not requests/period", item)
+		}
+		var l Limit
+		var err error
+		if l.Requests, err = strconv.Atoi(value[0]); err != nil || l.Requests <= 0 {
+			return nil, fmt.Errorf("rate limit %q has wrong amount of requests", item)
+		}
+		if l.Per, err = time.ParseDuration(value[1]); err != nil || l.Per <= 0 {
+			return nil, fmt.Errorf("rate limit %q has wrong period", item)
+		}
+		limits[name] = l
+	}
+	return limits, nil
+}
+
+// Store keeps buckets, Take has to be atomic as many requests of the same client can come at once
+type Store interface {
+	// Take refills the bucket up to now and removes one token if there is one.
+	// It returns tokens left in the bucket and whether the token was taken.
+	Take(ctx context.Context, key string, l Limit, now time.Time) (float64, bool, error)
+}
+
+// refill tells how many tokens the bucket has at now if it had tokens at updated
+func refill(tokens float64, updated time.Time, l Limit, now time.Time) float64 {
+	if elapsed := now.Sub(updated); elapsed > 0 {
+		tokens += elapsed.Seconds() * l.rate()
+	}
+	return math.Min(tokens, float64(l.Requests))
+}
+
+// fullAt is when the bucket with tokens at now is full again, the bucket can be forgotten after that
+func fullAt(tokens float64, l Limit, now time.Time) time.Time {
+	return now.Add(time.Duration((float64(l.Requests) - tokens) / l.rate() * float64(time.Second)))
+}
+
+// Result is the state of the bucket after the request, it is reported to the client in RateLimit-* headers
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is the time until the bucket is full
+	Reset time.Duration
+	// RetryAfter is the time until the next token when the request is not allowed
+	RetryAfter time.Duration
+}
+
+// Limiter takes tokens for the requests, limits of route groups may be replaced while it is used
+type Limiter struct {
+	store  Store
+	limits atomic.Value
+	now    func() time.Time
+}
+
+// New limits route groups of limits, groups missing in them are not limited
+func New(store Store, limits map[string]Limit) *Limiter {
+	l := &Limiter{store: store, now: time.Now}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits replaces limits of all route groups, buckets are kept and fit the new limits on the next request
+func (l *Limiter) SetLimits(limits map[string]Limit) {
+	l.limits.Store(limits)
+}
+
+// Limit of the route group, ok is false when the group is not limited
+func (l *Limiter) Limit(group string) (limit Limit, ok bool) {
+	limit, ok = l.limits.Load().(map[string]Limit)[group]
+	return limit, ok
+}
+
+// Allow takes a token from the bucket of the key
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := l.now()
+	tokens, ok, err := l.store.Take(ctx, key, limit, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	res := Result{
+		Allowed:   ok,
+		Limit:     limit.Requests,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     fullAt(tokens, limit, now).Sub(now),
+	}
+	if !ok {
+		res.RetryAfter = time.Duration((1 - tokens) / limit.rate() * float64(time.Second))
+	}
+	return res, nil
+}
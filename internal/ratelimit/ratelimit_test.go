@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]Limit
+		wantErr bool
+	}{
+		{name: "defaults",
+			value: "",
+			want:  DefaultLimits,
+		},
+		{name: "override",
+			value: "api=100/1s, orders_upload=5/1h",
+			want: map[string]Limit{
+				RouteAPI:          {Requests: 100, Per: time.Second},
+				RouteAuth:         DefaultLimits[RouteAuth],
+				RouteOrdersUpload: {Requests: 5, Per: time.Hour},
+			},
+		},
+		{name: "unknown_group",
+			value:   "withdraw=1/1m",
+			wantErr: true,
+		},
+		{name: "no_period",
+			value:   "api=100",
+			wantErr: true,
+		},
+		{name: "zero_requests",
+			value:   "api=0/1m",
+			wantErr: true,
+		},
+		{name: "wrong_period",
+			value:   "api=10/minute",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLimits(tt.value)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	l := New(NewMemoryStore(), DefaultLimits)
+	l.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Per: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		res, err := l.Allow(ctx, "api:user:1", limit)
+		require.NoError(t, err)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+
+	res, err := l.Allow(ctx, "api:user:1", limit)
+	require.NoError(t, err)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, time.Second, res.RetryAfter)
+	assert.Equal(t, 3*time.Second, res.Reset)
+
+	res, err = l.Allow(ctx, "api:user:2", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed, "other keys have their own buckets")
+
+	now = now.Add(1500 * time.Millisecond)
+	res, err = l.Allow(ctx, "api:user:1", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+	assert.Equal(t, 2500*time.Millisecond, res.Reset)
+
+	now = now.Add(time.Hour)
+	res, err = l.Allow(ctx, "api:user:1", limit)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Remaining, "bucket is never fuller than the limit")
+
+	l.SetLimits(map[string]Limit{RouteAPI: limit})
+	got, ok := l.Limit(RouteAPI)
+	assert.True(t, ok)
+	assert.Equal(t, limit, got)
+	_, ok = l.Limit(RouteAuth)
+	assert.False(t, ok, "groups missing in limits are not limited")
+}
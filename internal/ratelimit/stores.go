@@ -0,0 +1,110 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/jackc/pgx/v4"
+)
+
+// pruneEvery is how many requests are counted between removals of full buckets
+const pruneEvery = 10000
+
+// MemoryStore keeps buckets in the process, every instance limits clients on its own
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, l Limit, now time.Time) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%pruneEvery == 0 {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Requests), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, b.updated, l, now)
+	b.updated = now
+
+	taken := b.tokens >= 1
+	if taken {
+		b.tokens--
+	}
+	b.full = fullAt(b.tokens, l, now)
+	return b.tokens, taken, nil
+}
+
+// PGStore keeps buckets in rate_limits table, so that all instances share them
+type PGStore struct {
+	conn  storage.PGinterface
+	takes int64
+}
+
+func NewPGStore(conn storage.PGinterface) *PGStore {
+	return &PGStore{conn: conn}
+}
+
+func (s *PGStore) Take(ctx context.Context, key string, l Limit, now time.Time) (float64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if atomic.AddInt64(&s.takes, 1)%pruneEvery == 0 {
+		// a bucket untouched for the whole period is full, forgetting it changes nothing
+		_, err := s.conn.Exec(ctx, `DELETE FROM rate_limits WHERE updated_at + per * interval '1 second' < $1`, now)
+		if err != nil {
+			return 0, false, fmt.Errorf("prune rate limits failed: %v", err)
+		}
+	}
+
+	// the bucket is refilled and the token is taken in one statement, nothing is updated when there is no token
+	var tokens float64
+	err := s.conn.QueryRow(ctx, `INSERT INTO rate_limits (key, tokens, updated_at, per) VALUES($1, $2::float8 - 1, $3, $5)
+								ON CONFLICT (key) DO UPDATE SET
+									tokens = LEAST($2::float8, rate_limits.tokens +
+										GREATEST(EXTRACT(EPOCH FROM $3::timestamptz - rate_limits.updated_at), 0) * $4::float8) - 1,
+									updated_at = $3,
+									per = $5
+								WHERE LEAST($2::float8, rate_limits.tokens +
+										GREATEST(EXTRACT(EPOCH FROM $3::timestamptz - rate_limits.updated_at), 0) * $4::float8) >= 1
+								RETURNING tokens`, key, float64(l.Requests), now, l.rate(), l.Per.Seconds()).
+		Scan(&tokens)
+	if err == nil {
+		return tokens, true, nil
+	} else if err != pgx.ErrNoRows {
+		return 0, false, fmt.Errorf("take rate limit token failed: %v", err)
+	}
+
+	// no token, the bucket is only read to tell the client when to come back
+	var updated time.Time
+	err = s.conn.QueryRow(ctx, `SELECT tokens, updated_at FROM rate_limits WHERE key=$1`, key).Scan(&tokens, &updated)
+	if err != nil {
+		return 0, false, fmt.Errorf("select rate limit failed: %v", err)
+	}
+	return refill(tokens, updated, l, now), false, nil
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	// ErrUserNotFound is returned when there is no user with such id
+	ErrUserNotFound = errors.New("user not found")
+	// ErrInsufficientFunds is returned when a debit would make the balance negative
+	ErrInsufficientFunds = errors.New("balance is not enough")
+	// ErrOrderProcessed is returned when a processed order is requeued, its accrual is already credited
+	ErrOrderProcessed = errors.New("order is already processed")
+)
+
+const userInfoColumns = `u.id, u.login, u.role, u.blocked_at, u.created_at,
+	COALESCE((SELECT SUM(change) FROM bonuses b WHERE b.user_id=u.id AND b.status='PROCESSED'), 0)`
+
+func scanUserInfo(row pgx.Row) (*models.UserInfo, error) {
+	var u models.UserInfo
+	var blocked *time.Time
+	if err := row.Scan(&u.ID, &u.Login, &u.Role, &blocked, &u.CreatedAt, &u.Balance); err != nil {
+		return nil, err
+	}
+	if blocked != nil {
+		u.BlockedAt = *blocked
+	}
+	return &u, nil
+}
+
+// SelectUserAccess returns role of the user and whether the user is blocked
+func (db *PGDB) SelectUserAccess(ctx context.Context, id int64) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var role string
+	var blocked bool
+	err := db.Conn.QueryRow(ctx, `SELECT role, blocked_at IS NOT NULL FROM users WHERE id=$1`, id).Scan(&role, &blocked)
+	if err == pgx.ErrNoRows {
+		return "", false, ErrUserNotFound
+	} else if err != nil {
+		return "", false, fmt.Errorf("select user access failed: %v", err)
+	}
+
+	return role, blocked, nil
+}
+
+// SearchUsers finds users by id or by part of login
+func (db *PGDB) SearchUsers(ctx context.Context, query string, limit int) ([]models.UserInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	id, _ := strconv.ParseInt(query, 10, 64)
+	rows, err := db.Conn.Query(ctx, `SELECT `+userInfoColumns+` FROM users u
+									WHERE u.id=$1 OR u.login ILIKE '%' || $2 || '%' ORDER BY u.id LIMIT $3`, id, query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("search users failed: %v", err)
+	}
+	defer rows.Close()
+
+	var users []models.UserInfo
+	for rows.Next() {
+		u, err := scanUserInfo(rows)
+		if err != nil {
+			return nil, fmt.Errorf("search users failed: %v", err)
+		}
+		users = append(users, *u)
+	}
+
+	return users, rows.Err()
+}
+
+// SelectUser returns the user with the current balance
+func (db *PGDB) SelectUser(ctx context.Context, id int64) (*models.UserInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	u, err := scanUserInfo(db.Conn.QueryRow(ctx, `SELECT `+userInfoColumns+` FROM users u WHERE u.id=$1`, id))
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select user failed: %v", err)
+	}
+
+	return u, nil
+}
+
+// SelectLedger returns all changes of user's bonuses from the oldest one with the running balance
+func (db *PGDB) SelectLedger(ctx context.Context, id int64) ([]models.LedgerEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := db.Conn.Query(ctx, `SELECT id, COALESCE(order_id, 0), type, status, change, COALESCE(reason, ''), change_date,
+										SUM(CASE WHEN status='PROCESSED' THEN change ELSE 0 END) OVER (ORDER BY change_date, id)
+									FROM bonuses WHERE user_id=$1 ORDER BY change_date, id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("select ledger failed: %v", err)
+	}
+	defer rows.Close()
+
+	var ledger []models.LedgerEntry
+	for rows.Next() {
+		var e models.LedgerEntry
+		if err := rows.Scan(&e.ID, &e.Order, &e.Type, &e.Status, &e.Change, &e.Reason, &e.Date, &e.Balance); err != nil {
+			return nil, fmt.Errorf("select ledger failed: %v", err)
+		}
+		ledger = append(ledger, e)
+	}
+
+	return ledger, rows.Err()
+}
+
+// AdjustBalance credits or debits user's bonuses by staff, the change is recorded in the ledger and in the audit log
+func (db *PGDB) AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEvent) error {
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			if err := lockUser(ctx, tx, adj.UserID); err != nil {
+				return err
+			}
+
+			var before int64
+			err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(change), 0) FROM bonuses WHERE user_id=$1 AND status='PROCESSED'`,
+				adj.UserID).Scan(&before)
+			if err != nil {
+				return fmt.Errorf("select balance failed: %v", err)
+			}
+			if before+adj.Amount < 0 {
+				return ErrInsufficientFunds
+			}
+
+			var entry int64
+			err = tx.QueryRow(ctx, `INSERT INTO bonuses (user_id, change, type, status, reason) VALUES($1,$2,'adjustment','PROCESSED',$3)
+									RETURNING id`, adj.UserID, adj.Amount, adj.Reason).Scan(&entry)
+			if err != nil {
+				return fmt.Errorf("insert adjustment failed: %v", err)
+			}
+
+			if _, err := tx.Exec(ctx, `UPDATE users SET balance=balance+$1 WHERE id=$2`, adj.Amount, adj.UserID); err != nil {
+				return fmt.Errorf("update amount failed: %v", err)
+			}
+
+			audit.Before, _ = json.Marshal(map[string]int64{"balance": before})
+			audit.After, _ = json.Marshal(map[string]int64{"balance": before + adj.Amount, "entry_id": entry})
+			return insertAudit(ctx, tx, audit)
+		})
+
+	if err != nil {
+		return fmt.Errorf("adjust balance failed: %w", err)
+	}
+
+	return nil
+}
+
+// SetUserBlocked blocks or unblocks the user, blocked users can neither log in nor use their tokens
+func (db *PGDB) SetUserBlocked(ctx context.Context, id int64, blocked bool, audit models.AuditEvent) error {
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			var before bool
+			err := tx.QueryRow(ctx, `SELECT blocked_at IS NOT NULL FROM users WHERE id=$1 FOR UPDATE`, id).Scan(&before)
+			if err == pgx.ErrNoRows {
+				return ErrUserNotFound
+			} else if err != nil {
+				return fmt.Errorf("select user failed: %v", err)
+			}
+
+			_, err = tx.Exec(ctx, `UPDATE users SET blocked_at = CASE WHEN $2 THEN COALESCE(blocked_at, current_timestamp) END
+									WHERE id=$1`, id, blocked)
+			if err != nil {
+				return fmt.Errorf("update user failed: %v", err)
+			}
+
+			audit.Before, _ = json.Marshal(map[string]bool{"blocked": before})
+			audit.After, _ = json.Marshal(map[string]bool{"blocked": blocked})
+			return insertAudit(ctx, tx, audit)
+		})
+
+	if err != nil {
+		return fmt.Errorf("set user blocked failed: %w", err)
+	}
+
+	return nil
+}
+
+// SetUserRole changes the role of the user, it is applied to the tokens issued after the change
+func (db *PGDB) SetUserRole(ctx context.Context, id int64, role string, audit models.AuditEvent) error {
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			var before string
+			err := tx.QueryRow(ctx, `SELECT role FROM users WHERE id=$1 FOR UPDATE`, id).Scan(&before)
+			if err == pgx.ErrNoRows {
+				return ErrUserNotFound
+			} else if err != nil {
+				return fmt.Errorf("select user failed: %v", err)
+			}
+
+			if _, err := tx.Exec(ctx, `UPDATE users SET role=$2 WHERE id=$1`, id, role); err != nil {
+				return fmt.Errorf("update user failed: %v", err)
+			}
+
+			audit.Before, _ = json.Marshal(map[string]string{"role": before})
+			audit.After, _ = json.Marshal(map[string]string{"role": role})
+			return insertAudit(ctx, tx, audit)
+		})
+
+	if err != nil {
+		return fmt.Errorf("set user role failed: %w", err)
+	}
+
+	return nil
+}
+
+// SetUserPassword replaces hash of the password, the hash is never written to the audit log
+func (db *PGDB) SetUserPassword(ctx context.Context, id int64, hash string, audit models.AuditEvent) error {
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			tag, err := tx.Exec(ctx, `UPDATE users SET password=$2 WHERE id=$1`, id, hash)
+			if err != nil {
+				return fmt.Errorf("update user failed: %v", err)
+			} else if tag.RowsAffected() == 0 {
+				return ErrUserNotFound
+			}
+			return insertAudit(ctx, tx, audit)
+		})
+
+	if err != nil {
+		return fmt.Errorf("set user password failed: %w", err)
+	}
+
+	return nil
+}
+
+// RequeueOrder returns order which is stuck or was wrongly marked invalid to the worker,
+// it is checked in accrual system again as a new one
+func (db *PGDB) RequeueOrder(ctx context.Context, number int64, audit models.AuditEvent) error {
+	var change *models.OrderEvent
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			var before string
+			var user int64
+			err := tx.QueryRow(ctx, `SELECT status, user_id FROM bonuses WHERE order_id=$1 AND type='top_up' FOR UPDATE`,
+				number).Scan(&before, &user)
+			if err == pgx.ErrNoRows {
+				return ErrOrderNotFound
+			} else if err != nil {
+				return fmt.Errorf("select order failed: %v", err)
+			} else if before == "PROCESSED" {
+				return ErrOrderProcessed
+			}
+
+			_, err = tx.Exec(ctx, `UPDATE bonuses SET status='NEW', checked_at=NULL WHERE order_id=$1 AND type='top_up'`, number)
+			if err != nil {
+				return fmt.Errorf("update order failed: %v", err)
+			}
+
+			audit.Before, _ = json.Marshal(map[string]string{"status": before})
+			audit.After, _ = json.Marshal(map[string]string{"status": "NEW"})
+			if err := insertAudit(ctx, tx, audit); err != nil {
+				return err
+			}
+
+			if before != "NEW" {
+				change, err = insertOrderEvent(ctx, tx, models.OrderEvent{UserID: user, Order: number, Status: "NEW"})
+			}
+			return err
+		})
+
+	if err != nil {
+		return fmt.Errorf("requeue order failed: %w", err)
+	}
+
+	if change != nil && db.onOrderEvent != nil {
+		db.onOrderEvent(*change)
+	}
+
+	return nil
+}
+
+func lockUser(ctx context.Context, tx pgx.Tx, id int64) error {
+	var locked int64
+	err := tx.QueryRow(ctx, `SELECT id FROM users WHERE id=$1 FOR UPDATE`, id).Scan(&locked)
+	if err == pgx.ErrNoRows {
+		return ErrUserNotFound
+	} else if err != nil {
+		return fmt.Errorf("lock user failed: %v", err)
+	}
+	return nil
+}
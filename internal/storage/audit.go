@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgconn"
+)
+
+// execer is either the pool or a transaction
+type execer interface {
+	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
+}
+
+// InsertAudit records the action which does not change anything in the db by itself, e.g. login.
+// Actions which do have to write their audit events in the same transaction.
+func (db *PGDB) InsertAudit(ctx context.Context, ev models.AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	return insertAudit(ctx, db.Conn, ev)
+}
+
+// ExportAudit calls fn for every event matching the filter from the oldest one, export stops on the first error of fn
+func (db *PGDB) ExportAudit(ctx context.Context, f models.AuditFilter, fn func(models.AuditEvent) error) error {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.ActorID != 0 {
+		add("actor_id=$%d", f.ActorID)
+	}
+	if f.Target != "" {
+		add("target=$%d", f.Target)
+	}
+	if f.Action != "" {
+		add("action=$%d", f.Action)
+	}
+	if !f.From.IsZero() {
+		add("created_at>=$%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at<$%d", f.To)
+	}
+
+	query := `SELECT id, COALESCE(actor_id, 0), action, target, COALESCE(reason, ''), before::text, after::text,
+				COALESCE(ip, ''), COALESCE(request_id, ''), created_at FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	rows, err := db.Conn.Query(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return fmt.Errorf("select audit events failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ev models.AuditEvent
+		var before, after *string
+		err := rows.Scan(&ev.ID, &ev.ActorID, &ev.Action, &ev.Target, &ev.Reason, &before, &after, &ev.IP, &ev.RequestID,
+			&ev.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("select audit events failed: %v", err)
+		}
+		if before != nil {
+			ev.Before = []byte(*before)
+		}
+		if after != nil {
+			ev.After = []byte(*after)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// insertAudit appends the event to the log, rows of audit_events are never updated
+func insertAudit(ctx context.Context, conn execer, ev models.AuditEvent) error {
+	jsonb := func(v []byte) *string {
+		if len(v) == 0 {
+			return nil
+		}
+		s := string(v)
+		return &s
+	}
+	var actor *int64
+	if ev.ActorID != 0 {
+		actor = &ev.ActorID
+	}
+
+	_, err := conn.Exec(ctx, `INSERT INTO audit_events (actor_id, action, target, reason, before, after, ip, request_id)
+								VALUES($1,$2,$3,$4,$5::jsonb,$6::jsonb,$7,$8)`,
+		actor, ev.Action, ev.Target, ev.Reason, jsonb(ev.Before), jsonb(ev.After), ev.IP, ev.RequestID)
+	if err != nil {
+		return fmt.Errorf("insert audit event failed: %v", err)
+	}
+
+	return nil
+}
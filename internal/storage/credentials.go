@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// credentials of the db are used for new connections, they may be rotated while the service runs
+type credentials struct {
+	user     string
+	password string
+}
+
+// RotateCredentials makes new connections log in with user and password of the uri, open connections stay
+// as they are. Other parts of the uri, like host or database, are not changed without restart.
+func (db *PGDB) RotateCredentials(uri string) error {
+	next, err := pgx.ParseConfig(uri)
+	if err != nil {
+		return fmt.Errorf("parse database uri failed: %v", err)
+	}
+	cur, err := pgx.ParseConfig(db.path)
+	if err != nil {
+		return fmt.Errorf("parse database uri failed: %v", err)
+	}
+	if next.Host != cur.Host || next.Port != cur.Port || next.Database != cur.Database {
+		return errors.New("only user and password of the db may change without restart")
+	}
+	db.creds.Store(credentials{user: next.User, password: next.Password})
+	return nil
+}
+
+// useCredentials puts the current user and password into config of a new connection
+func (db *PGDB) useCredentials(ctx context.Context, cc *pgx.ConnConfig) error {
+	if c, ok := db.creds.Load().(credentials); ok {
+		cc.User, cc.Password = c.user, c.password
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GoSeoTaxi/t1/internal/config"
 	"github.com/GoSeoTaxi/t1/internal/models"
@@ -9,11 +11,26 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/zap"
-	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// migrationLockID is the key of pg advisory lock held while migrations are applied
+const migrationLockID = 20220726
+
+// archiveMigration moves rows of bonuses which violate its constraints to bonuses_archive
+const archiveMigration = 1
+
+var (
+	// ErrOrderExists is returned when the order was already uploaded by the same user
+	ErrOrderExists = errors.New("order already uploaded by this user")
+	// ErrOrderConflict is returned when the order was already uploaded by another user
+	ErrOrderConflict = errors.New("order already uploaded by another user")
+	// ErrOrderNotFound is returned when there is no order with such number
+	ErrOrderNotFound = errors.New("order not found")
+)
+
 type PGinterface interface {
 	Begin(context.Context) (pgx.Tx, error)
 	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
@@ -23,79 +40,234 @@ type PGinterface interface {
 }
 
 type DBinterface interface {
-	CreateNewUser(context.Context, *models.User) (int, error)
+	CreateNewUser(context.Context, *models.User, models.AuditEvent) (int, error)
 	SelectPass(context.Context, *models.User) (*string, error)
 	SelectBalance(context.Context, int64) (*models.Balance, error)
-	SelectUserForOrder(context.Context, models.Order) (int64, error)
-	InsertOrder(context.Context, models.Order) error
+	InsertOrder(context.Context, models.Order, models.AuditEvent) error
+	InsertOrders(context.Context, []models.Order, models.AuditEvent) ([]error, error)
 	SelectOrdersForUpdate(context.Context, *config.Config, chan []models.Order, chan models.Order)
 	SelectAllOrders(context.Context, int64) ([]*models.Order, error)
+	SelectOrders(context.Context, int64, models.OrderFilter) ([]*models.Order, error)
+	SelectOrder(context.Context, int64) (*models.Order, error)
 	SelectAllWithdrawals(context.Context, int64) (*[]models.Withdrawal, error)
+	SelectOrderEvents(context.Context, int64, int64) ([]models.OrderEvent, error)
+	CreateWebhook(context.Context, *models.Webhook) error
+	SelectWebhooks(context.Context, int64) ([]models.Webhook, error)
+	DeleteWebhook(context.Context, int64, int64) error
+	SelectWebhookDeliveries(context.Context, int64, int64) ([]models.WebhookDelivery, error)
+	ClaimWebhookMessages(context.Context, int) ([]models.WebhookMessage, error)
+	RecordWebhookDelivery(context.Context, models.WebhookDelivery, bool, time.Time) error
+	EnqueueWebhooks(context.Context, models.DomainEvent) error
+	ProcessOutbox(context.Context, int, func([]models.DomainEvent) []int64) (int, error)
+	SelectUserAccess(context.Context, int64) (string, bool, error)
+	SearchUsers(context.Context, string, int) ([]models.UserInfo, error)
+	SelectUser(context.Context, int64) (*models.UserInfo, error)
+	SelectLedger(context.Context, int64) ([]models.LedgerEntry, error)
+	AdjustBalance(context.Context, models.Adjustment, models.AuditEvent) error
+	SetUserBlocked(context.Context, int64, bool, models.AuditEvent) error
+	SetUserRole(context.Context, int64, string, models.AuditEvent) error
+	RequeueOrder(context.Context, int64, models.AuditEvent) error
+	InsertAudit(context.Context, models.AuditEvent) error
+	ExportAudit(context.Context, models.AuditFilter, func(models.AuditEvent) error) error
 }
 
 type PGDB struct {
-	path string
-	Conn PGinterface
-	log  *zap.Logger
+	path         string
+	Conn         PGinterface
+	log          *zap.Logger
+	onOrderEvent func(models.OrderEvent)
+	creds        atomic.Value
 }
 
 // InitDB initialized pg connection and creates tables
 func InitDB(ctx context.Context, cfg *config.Config, logger *zap.Logger) (*PGDB, error) {
+	db, err := Connect(ctx, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Migrate(ctx); err != nil {
+		db.Conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Connect opens the pool of connections, tables are neither created nor migrated
+func Connect(ctx context.Context, cfg *config.Config, logger *zap.Logger) (*PGDB, error) {
 	db := PGDB{
 		path: cfg.DBpath,
 		log:  logger,
 	}
-	conn, err := pgxpool.Connect(ctx, cfg.DBpath)
+	poolCfg, err := pgxpool.ParseConfig(cfg.DBpath)
+	if err != nil {
+		return nil, fmt.Errorf("parse database uri failed: %v", err)
+	}
+	poolCfg.BeforeConnect = db.useCredentials
+	conn, err := pgxpool.ConnectConfig(ctx, poolCfg)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to database: %v", err)
 	}
 	db.Conn = conn
 
+	return &db, nil
+}
+
+// Migrate creates tables and applies migrations which are not yet applied
+func (db *PGDB) Migrate(ctx context.Context) error {
 	db.log.Info("initializing db tables...")
 
 	tx, err := db.Conn.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("cannot connect to db: %v", err)
+		return fmt.Errorf("cannot connect to db: %v", err)
 	}
 
 	defer tx.Rollback(ctx)
 
 	//Кажется вот тут Илья Сухов имел ввиду добавить recovery...
 
-	for _, q := range strings.Split(CreateDB, ";") {
-		q := strings.TrimSpace(q)
-		if q == "" {
+	if err := execScript(ctx, tx, CreateDB); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+
+	if err := db.migrate(ctx); err != nil {
+		return err
+	}
+	db.log.Info("db initialized succesfully")
+
+	return nil
+}
+
+// execScript runs every statement of an sql script separated by ';' inside the transaction
+func execScript(ctx context.Context, tx pgx.Tx, script string) error {
+	for _, q := range splitScript(script) {
+		if _, err := tx.Exec(ctx, q); err != nil {
+			return fmt.Errorf("failed executing sql: %v", err)
+		}
+	}
+	return nil
+}
+
+// splitScript splits the script into statements by semicolons, those within $$ quoted function bodies are kept
+func splitScript(script string) []string {
+	var statements []string
+	var current string
+	for _, part := range strings.Split(script, ";") {
+		current += part
+		if strings.Count(current, "$$")%2 == 1 {
+			current += ";"
 			continue
 		}
-		if _, err := tx.Exec(ctx, q); err != nil {
-			return nil, fmt.Errorf("failed executing sql: %v", err)
+		if q := strings.TrimSpace(current); q != "" {
+			statements = append(statements, q)
 		}
+		current = ""
 	}
-	if err := tx.Commit(ctx); err != nil {
-		return nil, fmt.Errorf("commit failed: %v", err)
+	return statements
+}
+
+// migrate applies all migrations which are not yet recorded in schema_migrations,
+// advisory lock keeps several instances from migrating at the same time
+func (db *PGDB) migrate(ctx context.Context) error {
+	for i, m := range Migrations {
+		version := i + 1
+		err := db.doAsTransaction(ctx, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+				return fmt.Errorf("lock for migration failed: %v", err)
+			}
+
+			var applied bool
+			err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version=$1)", version).Scan(&applied)
+			if err != nil {
+				return fmt.Errorf("select migration version failed: %v", err)
+			}
+			if applied {
+				return nil
+			}
+
+			db.log.Info("applying migration", zap.Int("version", version))
+			if err := execScript(ctx, tx, m); err != nil {
+				return err
+			}
+			if version == archiveMigration {
+				if err := db.logArchived(ctx, tx); err != nil {
+					return err
+				}
+			}
+
+			if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES($1)", version); err != nil {
+				return fmt.Errorf("insert migration version failed: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", version, err)
+		}
 	}
-	db.log.Info("db initialized succesfully")
 
-	return &db, nil
+	return nil
+}
+
+// logArchived warns about every row of the ledger moved to bonuses_archive, balances of their users
+// are recounted without them
+func (db *PGDB) logArchived(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, `SELECT id, COALESCE(user_id, 0), COALESCE(order_id, 0), COALESCE(change, 0), reason
+									FROM bonuses_archive ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("select archived bonuses failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, user, order, change int64
+		var reason string
+		if err := rows.Scan(&id, &user, &order, &change, &reason); err != nil {
+			return fmt.Errorf("select archived bonuses failed: %v", err)
+		}
+		db.log.Warn("row of bonuses is moved to bonuses_archive", zap.Int64("id", id), zap.Int64("user", user),
+			zap.Int64("order", order), zap.Int64("change", change), zap.String("reason", reason))
+	}
+	return rows.Err()
 }
 
-// CreateNewUser insertes new user, handles not unique users
-func (db *PGDB) CreateNewUser(ctx context.Context, user *models.User) (int, error) {
+// CreateNewUser insertes new user, handles not unique users. The audit event of the registration is written
+// in the same transaction with the new user as the target, and as the actor if it is models.ActorSelf.
+func (db *PGDB) CreateNewUser(ctx context.Context, user *models.User, audit models.AuditEvent) (int, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	err := db.Conn.QueryRow(ctx, `INSERT INTO users (login, password) VALUES($1,$2) RETURNING id;`, user.Login, user.Password).Scan(&user.ID)
+	var exists bool
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			err := tx.QueryRow(ctx, `INSERT INTO users (login, password) VALUES($1,$2) ON CONFLICT (login) DO NOTHING RETURNING id`,
+				user.Login, user.Password).Scan(&user.ID)
+			if err == pgx.ErrNoRows {
+				exists = true
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("insert new user failed: %v", err)
+			}
 
-	if err != nil && strings.Contains(err.Error(), "violates") {
-		return -1, fmt.Errorf("user already exists: %v", err)
-	} else if err != nil {
-		return 0, fmt.Errorf("insert new user failed: %v", err)
+			if audit.ActorID == models.ActorSelf {
+				audit.ActorID = user.ID
+			}
+			audit.Target = models.UserTarget(user.ID)
+			audit.After, _ = json.Marshal(map[string]string{"login": user.Login, "role": models.RoleUser})
+			return insertAudit(ctx, tx, audit)
+		})
+
+	if err != nil {
+		return 0, fmt.Errorf("create new user failed: %w", err)
+	} else if exists {
+		return -1, fmt.Errorf("user %s already exists", user.Login)
 	}
 
 	return 1, nil
 }
 
-// SelectPass gets hashed password for a particular user
+// SelectPass gets hashed password for a particular user, ErrUserNotFound is returned if there is no such login
 func (db *PGDB) SelectPass(ctx context.Context, user *models.User) (*string, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
@@ -103,10 +275,11 @@ func (db *PGDB) SelectPass(ctx context.Context, user *models.User) (*string, err
 	row := db.Conn.QueryRow(ctx, "SELECT password, id FROM users WHERE login=$1", user.Login)
 	err := row.Scan(&val, &user.ID)
 
-	if err != nil {
+	if err == pgx.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
 		return nil, fmt.Errorf("select from users failed: %v", err)
 	}
-	// TODO user does not exist
 	return &val, nil
 }
 
@@ -115,7 +288,7 @@ func (db *PGDB) SelectBalance(ctx context.Context, user int64) (*models.Balance,
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	var val models.Balance
-	row := db.Conn.QueryRow(ctx, "SELECT COALESCE(SUM(change), 0), COALESCE(SUM(nullif(LEAST(change, 0),0)),0) FROM bonuses WHERE user_id=$1 AND status='PROCESSED'", user)
+	row := db.Conn.QueryRow(ctx, "SELECT COALESCE(SUM(change), 0), COALESCE(SUM(change) FILTER (WHERE type='withdraw'), 0) FROM bonuses WHERE user_id=$1 AND status='PROCESSED'", user)
 	err := row.Scan(&val.Current, &val.Withdrawn)
 
 	if err != nil {
@@ -125,24 +298,6 @@ func (db *PGDB) SelectBalance(ctx context.Context, user int64) (*models.Balance,
 	return &val, nil
 }
 
-// SelectUserForOrder tries to find if some order id was already used and if yes by which user
-func (db *PGDB) SelectUserForOrder(ctx context.Context, order models.Order) (int64, error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-	var val int64
-	row := db.Conn.QueryRow(ctx, "SELECT users.id FROM users JOIN bonuses ON users.id=bonuses.user_id WHERE order_id=$1", order.ID)
-	err := row.Scan(&val)
-
-	if err == pgx.ErrNoRows {
-		return 0, nil
-	}
-	if err != nil {
-		return 0, fmt.Errorf("select from users failed: %v", err)
-	}
-
-	return val, nil
-}
-
 // doAsTransaction allow run sql statements inside one transaction
 func (db *PGDB) doAsTransaction(ctx context.Context, fu ...func(pgx.Tx) error) error {
 	/*ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -156,7 +311,7 @@ func (db *PGDB) doAsTransaction(ctx context.Context, fu ...func(pgx.Tx) error) e
 	for _, f := range fu {
 		err := f(tx)
 		if err != nil {
-			return fmt.Errorf("transaction failed: %v", err)
+			return fmt.Errorf("transaction failed: %w", err)
 		}
 	}
 
@@ -167,21 +322,33 @@ func (db *PGDB) doAsTransaction(ctx context.Context, fu ...func(pgx.Tx) error) e
 	return nil
 }
 
-// InsertOrder appends new order to existing bonuses
-func (db *PGDB) InsertOrder(ctx context.Context, order models.Order) error {
+// InsertOrder appends new order to existing bonuses, order numbers are unique so if the order
+// is already there ErrOrderExists or ErrOrderConflict is returned depending on who owns it.
+// Withdrawal locks the user, so that concurrent ones see each other, and ErrInsufficientFunds is returned
+// when the balance is not enough. The audit event is written for the order in the same transaction.
+func (db *PGDB) InsertOrder(ctx context.Context, order models.Order, audit models.AuditEvent) error {
 	err := db.doAsTransaction(ctx,
 		func(tx pgx.Tx) error {
-			_, err := tx.Prepare(ctx, "insert bonuses", `INSERT INTO bonuses (user_id, order_id, change, type, status) VALUES($1,$2,$3,$4,$5);`)
-
+			if order.Type != "withdraw" {
+				return nil
+			}
+			if err := lockUser(ctx, tx, order.UserID); err != nil {
+				return err
+			}
+			var balance int64
+			err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(change), 0) FROM bonuses WHERE user_id=$1 AND status='PROCESSED'`,
+				order.UserID).Scan(&balance)
 			if err != nil {
-				return fmt.Errorf("init bonuses insert failed: %v", err)
+				return fmt.Errorf("select balance failed: %v", err)
 			}
-
-			if _, err = tx.Exec(ctx, "insert bonuses", order.UserID, order.ID, order.Amount, order.Type, order.Status); err != nil {
-				return fmt.Errorf("update bonuses failed: %v", err)
+			if balance+order.Amount < 0 {
+				return ErrInsufficientFunds
 			}
 			return nil
 		},
+		func(tx pgx.Tx) error {
+			return insertBonus(ctx, tx, order)
+		},
 		func(tx pgx.Tx) error {
 			_, err := tx.Prepare(ctx, "update amount", `UPDATE users SET balance=balance+$1 where id=$2;`)
 
@@ -193,21 +360,109 @@ func (db *PGDB) InsertOrder(ctx context.Context, order models.Order) error {
 				return fmt.Errorf("update amount failed: %v", err)
 			}
 			return nil
+		},
+		func(tx pgx.Tx) error {
+			event := models.EventOrderAccepted
+			if order.Type == "withdraw" {
+				event = models.EventWithdrawalMade
+			}
+			return insertOutbox(ctx, tx, models.EventPayload{Event: event, UserID: order.UserID,
+				Order: order.ID, Status: order.Status, Amount: order.Amount, OccurredAt: time.Now()})
+		},
+		func(tx pgx.Tx) error {
+			return insertOrderAudit(ctx, tx, order, audit)
 		})
 
 	if err != nil {
-		return fmt.Errorf("do with transaction failed: %v", err)
+		return fmt.Errorf("do with transaction failed: %w", err)
 	}
 
 	return nil
 }
 
-// SelectAllOrders gets all orders for particular user
+// InsertOrders appends several new orders in one transaction, for each order the same error as from InsertOrder
+// is returned, the second return value is set only if the whole transaction failed.
+// The audit event is written for each inserted order.
+func (db *PGDB) InsertOrders(ctx context.Context, orders []models.Order, audit models.AuditEvent) ([]error, error) {
+	results := make([]error, len(orders))
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			for i, order := range orders {
+				err := insertBonus(ctx, tx, order)
+				if err != nil && !errors.Is(err, ErrOrderExists) && !errors.Is(err, ErrOrderConflict) {
+					return err
+				}
+				results[i] = err
+
+				if err == nil {
+					err = insertOutbox(ctx, tx, models.EventPayload{Event: models.EventOrderAccepted, UserID: order.UserID,
+						Order: order.ID, Status: order.Status, Amount: order.Amount, OccurredAt: time.Now()})
+					if err != nil {
+						return err
+					}
+					if err := insertOrderAudit(ctx, tx, order, audit); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("do with transaction failed: %w", err)
+	}
+
+	return results, nil
+}
+
+// insertOrderAudit records upload of the order or the withdrawal with the balance before and after it
+func insertOrderAudit(ctx context.Context, tx pgx.Tx, order models.Order, audit models.AuditEvent) error {
+	audit.Target = models.OrderTarget(order.ID)
+	if order.Type == "withdraw" {
+		var after int64
+		err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(change), 0) FROM bonuses WHERE user_id=$1 AND status='PROCESSED'`,
+			order.UserID).Scan(&after)
+		if err != nil {
+			return fmt.Errorf("select balance failed: %v", err)
+		}
+		audit.Before, _ = json.Marshal(map[string]int64{"balance": after - order.Amount})
+		audit.After, _ = json.Marshal(map[string]int64{"balance": after, "sum": -order.Amount})
+	} else {
+		audit.After, _ = json.Marshal(map[string]string{"status": order.Status})
+	}
+
+	return insertAudit(ctx, tx, audit)
+}
+
+// insertBonus inserts a row to bonuses and checks who owns the order if it already exists
+func insertBonus(ctx context.Context, tx pgx.Tx, order models.Order) error {
+	var id int64
+	err := tx.QueryRow(ctx, `INSERT INTO bonuses (user_id, order_id, change, type, status) VALUES($1,$2,$3,$4,$5)
+								ON CONFLICT (order_id) DO NOTHING RETURNING id;`,
+		order.UserID, order.ID, order.Amount, order.Type, order.Status).Scan(&id)
+
+	if err == nil {
+		return nil
+	} else if err != pgx.ErrNoRows {
+		return fmt.Errorf("update bonuses failed: %v", err)
+	}
+
+	var owner int64
+	if err := tx.QueryRow(ctx, "SELECT user_id FROM bonuses WHERE order_id=$1", order.ID).Scan(&owner); err != nil {
+		return fmt.Errorf("select order owner failed: %v", err)
+	}
+	if owner == order.UserID {
+		return ErrOrderExists
+	}
+	return ErrOrderConflict
+}
+
+// SelectAllOrders gets all uploaded orders for particular user
 func (db *PGDB) SelectAllOrders(ctx context.Context, u int64) ([]*models.Order, error) {
 	var listOrders []*models.Order
 
 	row, err := db.Conn.Query(context.Background(), `SELECT order_id, status, change, change_date 
-														FROM bonuses WHERE user_id=$1 ORDER BY change_date`, u)
+														FROM bonuses WHERE user_id=$1 AND type='top_up' ORDER BY change_date`, u)
 	if err != nil {
 		return nil, fmt.Errorf("init select from orders failed: %v", err)
 	}
@@ -225,6 +480,85 @@ func (db *PGDB) SelectAllOrders(ctx context.Context, u int64) ([]*models.Order,
 	return listOrders, nil
 }
 
+// SelectOrders gets one page of orders for particular user, pages are built with keyset on (change_date, id)
+// so that new orders do not shift pages which were already seen
+func (db *PGDB) SelectOrders(ctx context.Context, u int64, f models.OrderFilter) ([]*models.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	where := []string{"user_id=$1"}
+	args := []interface{}{u}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Type != "" {
+		where = append(where, "type="+arg(f.Type))
+	}
+	if len(f.Statuses) > 0 {
+		where = append(where, "status=ANY("+arg(f.Statuses)+")")
+	}
+	if !f.From.IsZero() {
+		where = append(where, "change_date>="+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		where = append(where, "change_date<"+arg(f.To))
+	}
+
+	cmp, order := ">", "ASC"
+	if f.Desc {
+		cmp, order = "<", "DESC"
+	}
+	if f.After != nil {
+		where = append(where, fmt.Sprintf("(change_date, id)%s(%s, %s)", cmp, arg(f.After.Date), arg(f.After.Seq)))
+	}
+
+	query := fmt.Sprintf(`SELECT id, order_id, status, change, change_date, type FROM bonuses
+							WHERE %s ORDER BY change_date %s, id %s LIMIT %s`, strings.Join(where, " AND "), order, order, arg(f.Limit))
+
+	row, err := db.Conn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("init select from orders failed: %v", err)
+	}
+	defer row.Close()
+
+	var listOrders []*models.Order
+	for row.Next() {
+		var o models.Order
+		if err := row.Scan(&o.Seq, &o.ID, &o.Status, &o.Amount, &o.Date, &o.Type); err != nil {
+			return nil, fmt.Errorf("select orders failed: %v", err)
+		}
+		listOrders = append(listOrders, &o)
+	}
+
+	return listOrders, row.Err()
+}
+
+// SelectOrder gets accrual order by its number whoever owns it, ErrOrderNotFound is returned if there is no such order.
+// Withdrawals are not orders, they are not returned.
+func (db *PGDB) SelectOrder(ctx context.Context, number int64) (*models.Order, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var o models.Order
+	var checked *time.Time
+	row := db.Conn.QueryRow(ctx, `SELECT id, order_id, user_id, status, change, change_date, type, checked_at
+									FROM bonuses WHERE order_id=$1 AND type='top_up'`, number)
+	err := row.Scan(&o.Seq, &o.ID, &o.UserID, &o.Status, &o.Amount, &o.Date, &o.Type, &checked)
+
+	if err == pgx.ErrNoRows {
+		return nil, ErrOrderNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("select order failed: %v", err)
+	}
+	if checked != nil {
+		o.CheckedAt = *checked
+	}
+
+	return &o, nil
+}
+
 // SelectAllWithdrawals gets all withdrwals for particular user
 func (db *PGDB) SelectAllWithdrawals(ctx context.Context, u int64) (*[]models.Withdrawal, error) {
 	var listOrders []models.Withdrawal
@@ -254,10 +588,11 @@ func (db *PGDB) SelectAllWithdrawals(ctx context.Context, u int64) (*[]models.Wi
 // oout channel recieves updated orders and allows update table as a stream
 func (db *PGDB) SelectOrdersForUpdate(ctx context.Context, cfg *config.Config, oin chan []models.Order, oout chan models.Order) {
 	var listOrders []models.Order
+	var changes []models.OrderEvent
 	err := db.doAsTransaction(ctx,
 		func(tx pgx.Tx) error {
 
-			row, err := tx.Query(context.Background(), `SELECT order_id, status FROM bonuses 
+			row, err := tx.Query(ctx, `SELECT order_id, status FROM bonuses 
 										WHERE status not in ('PROCESSED', 'INVALID') LIMIT $1 FOR UPDATE SKIP LOCKED`, cfg.RowsToUpdate)
 			if err != nil {
 				return fmt.Errorf("init select from bonuses failed: %v", err)
@@ -276,42 +611,73 @@ func (db *PGDB) SelectOrdersForUpdate(ctx context.Context, cfg *config.Config, o
 			return nil
 		},
 		func(tx pgx.Tx) error {
-			_, err := tx.Prepare(ctx, "update bonuses", `UPDATE bonuses SET change=$1, status=$2 where order_id=$3;`)
-
-			if err != nil {
-				return fmt.Errorf("init update users failed: %v", err)
-			}
-
-			_, err = tx.Prepare(ctx, "update user amount", `UPDATE users SET balance=balance+$1 where id=$2;`)
-
-			if err != nil {
-				return fmt.Errorf("init update users failed: %v", err)
-			}
-
 			for {
-			insertUpdates:
 				select {
 				case bonus, ok := <-oout:
 					if !ok {
-						break insertUpdates
+						return nil
 					}
-					if _, err = tx.Exec(ctx, "update user amount", bonus.Amount, bonus.UserID); err != nil {
-						return fmt.Errorf("update user amount failed: %v", err)
+					ev, err := updateBonus(ctx, tx, bonus)
+					if err != nil {
+						return err
 					}
-
-					if _, err = tx.Exec(ctx, "update bonuses", bonus.Amount, bonus.Status, bonus.ID); err != nil {
-						return fmt.Errorf("update amount failed: %v", err)
+					if ev != nil {
+						changes = append(changes, *ev)
 					}
 
 				case <-ctx.Done():
-					db.log.Info("context canceled")
-					return nil
+					// the batch is rolled back, its orders stay for the next run
+					return ctx.Err()
 				}
-				return nil
 			}
 		})
 
 	if err != nil {
-		log.Fatalf("transaction select bonuses for update failed: %v", err)
+		db.log.Error("transaction select bonuses for update failed", zap.Error(err))
+		return
+	}
+
+	if db.onOrderEvent != nil {
+		for _, ev := range changes {
+			db.onOrderEvent(ev)
+		}
+	}
+}
+
+// updateBonus saves accrual result for an order and credits the difference to the user,
+// if status or accrual changed an order event is recorded and pg listeners are notified on commit
+func updateBonus(ctx context.Context, tx pgx.Tx, bonus models.Order) (*models.OrderEvent, error) {
+	var ev models.OrderEvent
+	var delta int64
+	var changed bool
+	err := tx.QueryRow(ctx, `WITH old AS (SELECT id, status, change FROM bonuses WHERE order_id=$3)
+								UPDATE bonuses b SET change=$1, status=$2, checked_at=current_timestamp FROM old WHERE b.id=old.id
+								RETURNING b.user_id, b.order_id, b.status, b.change, b.change-old.change, b.status<>old.status OR b.change<>old.change`,
+		bonus.Amount, bonus.Status, bonus.ID).Scan(&ev.UserID, &ev.Order, &ev.Status, &ev.Amount, &delta, &changed)
+
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("update bonuses failed: %v", err)
+	}
+
+	if delta != 0 {
+		if _, err := tx.Exec(ctx, `UPDATE users SET balance=balance+$1 where id=$2;`, delta, ev.UserID); err != nil {
+			return nil, fmt.Errorf("update user amount failed: %v", err)
+		}
+	}
+
+	if !changed {
+		return nil, nil
+	}
+
+	if ev.Status == "PROCESSED" {
+		err := insertOutbox(ctx, tx, models.EventPayload{Event: models.EventOrderProcessed, UserID: ev.UserID,
+			Order: ev.Order, Status: ev.Status, Amount: ev.Amount, OccurredAt: time.Now()})
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	return insertOrderEvent(ctx, tx, ev)
 }
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// OrderEventsChannel is pg channel where order events are sent with NOTIFY
+const OrderEventsChannel = "order_events"
+
+// orderNotification is the payload of NOTIFY, unlike api json it keeps the owner of the order
+type orderNotification struct {
+	ID     int64     `json:"id"`
+	UserID int64     `json:"user_id"`
+	Order  int64     `json:"order_id"`
+	Status string    `json:"status"`
+	Amount int64     `json:"change"`
+	Date   time.Time `json:"created_at"`
+}
+
+// OnOrderEvent sets function called for every order event made by this instance after it is commited
+func (db *PGDB) OnOrderEvent(fn func(models.OrderEvent)) {
+	db.onOrderEvent = fn
+}
+
+// insertOrderEvent records order event and notifies pg listeners, notification is sent only when transaction commits.
+// Id of the event is the next number of the user taken under the lock of the user, so events of the user commit
+// in the order of their ids with no gaps, unlike the global serial which is taken before the commit order is known.
+func insertOrderEvent(ctx context.Context, tx pgx.Tx, ev models.OrderEvent) (*models.OrderEvent, error) {
+	if err := lockUser(ctx, tx, ev.UserID); err != nil {
+		return nil, err
+	}
+	err := tx.QueryRow(ctx, `INSERT INTO order_events (user_id, seq, order_id, status, change)
+								SELECT $1, COALESCE(MAX(seq), 0)+1, $2::bigint, $3::varchar, $4::bigint FROM order_events WHERE user_id=$1
+								RETURNING seq, created_at`,
+		ev.UserID, ev.Order, ev.Status, ev.Amount).Scan(&ev.ID, &ev.Date)
+	if err != nil {
+		return nil, fmt.Errorf("insert order event failed: %v", err)
+	}
+
+	payload, err := json.Marshal(orderNotification(ev))
+	if err != nil {
+		return nil, fmt.Errorf("prepare order event notification failed: %v", err)
+	}
+
+	if _, err := tx.Exec(ctx, "SELECT pg_notify($1, $2)", OrderEventsChannel, string(payload)); err != nil {
+		return nil, fmt.Errorf("notify order event failed: %v", err)
+	}
+
+	return &ev, nil
+}
+
+// SelectOrderEvents gets events of the user which happened after the event with given id, ids are numbers of the user
+func (db *PGDB) SelectOrderEvents(ctx context.Context, u int64, after int64) ([]models.OrderEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	row, err := db.Conn.Query(ctx, `SELECT seq, user_id, order_id, status, change, created_at
+										FROM order_events WHERE user_id=$1 AND seq>$2 ORDER BY seq`, u, after)
+	if err != nil {
+		return nil, fmt.Errorf("init select from order events failed: %v", err)
+	}
+	defer row.Close()
+
+	var list []models.OrderEvent
+	for row.Next() {
+		var ev models.OrderEvent
+		if err := row.Scan(&ev.ID, &ev.UserID, &ev.Order, &ev.Status, &ev.Amount, &ev.Date); err != nil {
+			return nil, fmt.Errorf("select order events failed: %v", err)
+		}
+		list = append(list, ev)
+	}
+
+	return list, row.Err()
+}
+
+// ListenOrderEvents receives order events made by all instances through pg LISTEN until ctx is done,
+// connection is restored if it breaks
+func (db *PGDB) ListenOrderEvents(ctx context.Context, fn func(models.OrderEvent)) {
+	for {
+		err := db.listen(ctx, fn)
+		if ctx.Err() != nil {
+			return
+		}
+		db.log.Error("listening to order events failed", zap.Error(err))
+
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listen holds dedicated connection with LISTEN until it fails, it is not taken from the pool
+// so that waiting for notifications does not hold one of the pool connections
+func (db *PGDB) listen(ctx context.Context, fn func(models.OrderEvent)) error {
+	cfg, err := pgxpool.ParseConfig(db.path)
+	if err != nil {
+		return fmt.Errorf("parse database uri failed: %v", err)
+	}
+	db.useCredentials(ctx, cfg.ConnConfig)
+
+	conn, err := pgx.ConnectConfig(ctx, cfg.ConnConfig)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %v", err)
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+OrderEventsChannel); err != nil {
+		return fmt.Errorf("listen failed: %v", err)
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for notification failed: %v", err)
+		}
+
+		var ev orderNotification
+		if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+			db.log.Error("order event notification is broken", zap.Error(err))
+			continue
+		}
+		fn(models.OrderEvent(ev))
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+)
+
+// Ping checks that the db answers
+func (db *PGDB) Ping(ctx context.Context) error {
+	if _, err := db.Conn.Exec(ctx, "SELECT 1"); err != nil {
+		return fmt.Errorf("ping db failed: %v", err)
+	}
+	return nil
+}
+
+// CheckMigrations checks that every migration known to this build is applied. Migrations of newer builds are fine,
+// so that old instances stay ready during a rolling update.
+func (db *PGDB) CheckMigrations(ctx context.Context) error {
+	var applied int
+	if err := db.Conn.QueryRow(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		return fmt.Errorf("select migration versions failed: %v", err)
+	}
+	if applied < len(Migrations) {
+		return fmt.Errorf("%d of %d migrations are applied", applied, len(Migrations))
+	}
+	return nil
+}
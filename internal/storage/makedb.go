@@ -21,4 +21,255 @@ CREATE TABLE IF NOT EXISTS bonuses   (
     FOREIGN KEY(user_id) REFERENCES users(id)
 );
 
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version int PRIMARY KEY,
+    applied_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
 `
+
+// Migrations are applied on top of CreateDB in the given order, each of them exactly once.
+// Version of a migration is its index in the slice plus one, so new migrations must only be appended.
+// Migrations never delete rows of the ledger, rows which can't be kept are moved to an archive table.
+var Migrations = []string{
+	// 1: constraints and indexes for bonuses, rows which violate them are moved to bonuses_archive rather than deleted,
+	// so that changes of balances are traced, the first row of an order number is kept
+	`
+CREATE TABLE IF NOT EXISTS bonuses_archive (
+    id int NOT NULL,
+    user_id bigint,
+    order_id bigint,
+    change bigint,
+    type varchar(40),
+    status varchar(40),
+    change_date timestamp,
+    reason text NOT NULL,
+    archived_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+WITH moved AS (
+    DELETE FROM bonuses WHERE user_id IS NULL OR order_id IS NULL
+    RETURNING id, user_id, order_id, change, type, status, change_date
+)
+INSERT INTO bonuses_archive (id, user_id, order_id, change, type, status, change_date, reason)
+SELECT id, user_id, order_id, change, type, status, change_date, 'user or order number is missing' FROM moved;
+
+WITH moved AS (
+    DELETE FROM bonuses b USING bonuses d WHERE b.order_id = d.order_id AND b.id > d.id
+    RETURNING b.id, b.user_id, b.order_id, b.change, b.type, b.status, b.change_date
+)
+INSERT INTO bonuses_archive (id, user_id, order_id, change, type, status, change_date, reason)
+SELECT id, user_id, order_id, change, type, status, change_date, 'order number is used by an earlier row' FROM moved;
+
+UPDATE bonuses SET change = 0 WHERE change IS NULL;
+UPDATE bonuses SET type = CASE WHEN change < 0 THEN 'withdraw' ELSE 'top_up' END WHERE type IS NULL;
+UPDATE bonuses SET status = CASE WHEN type = 'withdraw' THEN 'PROCESSED' ELSE 'NEW' END WHERE status IS NULL;
+UPDATE bonuses SET change_date = current_timestamp WHERE change_date IS NULL;
+
+UPDATE users SET balance = COALESCE((SELECT SUM(change) FROM bonuses WHERE bonuses.user_id = users.id AND status = 'PROCESSED'), 0);
+UPDATE users SET created_at = current_timestamp WHERE created_at IS NULL;
+
+ALTER TABLE users
+    ALTER COLUMN login SET NOT NULL,
+    ALTER COLUMN password SET NOT NULL,
+    ALTER COLUMN balance SET NOT NULL,
+    ALTER COLUMN created_at TYPE timestamptz,
+    ALTER COLUMN created_at SET NOT NULL;
+
+ALTER TABLE bonuses
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN order_id SET NOT NULL,
+    ALTER COLUMN change SET DEFAULT 0,
+    ALTER COLUMN change SET NOT NULL,
+    ALTER COLUMN type SET NOT NULL,
+    ALTER COLUMN status SET NOT NULL,
+    ALTER COLUMN change_date TYPE timestamptz,
+    ALTER COLUMN change_date SET NOT NULL,
+    DROP CONSTRAINT IF EXISTS bonuses_user_id_fkey,
+    ADD CONSTRAINT bonuses_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT,
+    ADD CONSTRAINT bonuses_order_id_key UNIQUE (order_id);
+
+CREATE INDEX IF NOT EXISTS bonuses_user_id_change_date_idx ON bonuses (user_id, change_date);
+
+CREATE INDEX IF NOT EXISTS bonuses_pending_idx ON bonuses (id) WHERE status NOT IN ('PROCESSED', 'INVALID');
+`,
+	// 2: time of the last check of an order in accrual system
+	`
+ALTER TABLE bonuses ADD COLUMN IF NOT EXISTS checked_at timestamptz;
+`,
+	// 3: changes of orders status and accrual which are streamed to users
+	`
+CREATE TABLE IF NOT EXISTS order_events (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id),
+    order_id bigint NOT NULL,
+    status varchar(40) NOT NULL,
+    change bigint NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS order_events_user_id_idx ON order_events (user_id, id);
+`,
+	// 4: webhooks with outbox of messages for them and log of delivery attempts
+	`
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id),
+    url text NOT NULL,
+    secret varchar(256) NOT NULL,
+    events text[] NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id bigserial PRIMARY KEY,
+    webhook_id bigint NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event varchar(40) NOT NULL,
+    payload jsonb NOT NULL,
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT current_timestamp,
+    delivered_at timestamptz,
+    failed_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS webhook_outbox_pending_idx ON webhook_outbox (next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    outbox_id bigint NOT NULL REFERENCES webhook_outbox(id) ON DELETE CASCADE,
+    attempt int NOT NULL,
+    status_code int,
+    error text,
+    duration_ms bigint NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_outbox_id_idx ON webhook_deliveries (outbox_id);
+`,
+	// 5: outbox of all domain events, webhook messages are made from it by the relay
+	`
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users(id),
+    event varchar(40) NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT current_timestamp,
+    published_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS event_id bigint;
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_outbox_event_idx ON webhook_outbox (webhook_id, event_id);
+`,
+	// 6: roles and blocking of users, manual balance adjustments and audit log of staff actions
+	`
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role varchar(20) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked_at timestamptz;
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'support', 'admin'));
+
+ALTER TABLE bonuses ADD COLUMN IF NOT EXISTS reason text;
+ALTER TABLE bonuses ALTER COLUMN order_id DROP NOT NULL;
+ALTER TABLE bonuses DROP CONSTRAINT IF EXISTS bonuses_type_check;
+ALTER TABLE bonuses ADD CONSTRAINT bonuses_type_check CHECK (type IN ('top_up', 'withdraw', 'adjustment'));
+ALTER TABLE bonuses ADD CONSTRAINT bonuses_order_id_check CHECK (order_id IS NOT NULL OR type = 'adjustment');
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    actor_id bigint REFERENCES users(id),
+    action varchar(60) NOT NULL,
+    target varchar(100) NOT NULL,
+    reason text,
+    details jsonb,
+    request_id varchar(100),
+    created_at timestamptz NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_target_idx ON audit_events (target, id);
+`,
+	// 7: partners upload orders of their customers
+	`
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_role_check;
+ALTER TABLE users ADD CONSTRAINT users_role_check CHECK (role IN ('user', 'support', 'admin', 'partner'));
+`,
+	// 8: audit log of security and money-moving actions, x_before and x_after keys of old details are split
+	// into before and after, rows are made append-only by 11
+	`
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS before jsonb;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS after jsonb;
+ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS ip varchar(45);
+UPDATE audit_events SET
+    before = (SELECT jsonb_object_agg(regexp_replace(key, '_before$', ''), value) FROM jsonb_each(details) WHERE key ~ '_before$'),
+    after = (SELECT jsonb_object_agg(regexp_replace(key, '_after$', ''), value) FROM jsonb_each(details) WHERE key !~ '_before$')
+WHERE details IS NOT NULL;
+ALTER TABLE audit_events DROP COLUMN IF EXISTS details;
+
+CREATE INDEX IF NOT EXISTS audit_events_actor_idx ON audit_events (actor_id, id);
+CREATE INDEX IF NOT EXISTS audit_events_created_idx ON audit_events (created_at);
+`,
+	// 9: failed logins per login and per IP
+	`
+CREATE TABLE IF NOT EXISTS login_throttle (
+    key varchar(300) PRIMARY KEY,
+    failures int NOT NULL,
+    last_failure timestamptz NOT NULL,
+    locked_until timestamptz
+);
+`,
+	// 10: token buckets of the API rate limiter shared by all instances
+	`
+CREATE TABLE IF NOT EXISTS rate_limits (
+    key varchar(300) PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamptz NOT NULL,
+    per double precision NOT NULL
+);
+`,
+	// 11: changes of the audit log fail loudly instead of being silently skipped by rules of the former 8,
+	// which have also let old details into after
+	`
+DROP RULE IF EXISTS audit_events_no_update ON audit_events;
+DROP RULE IF EXISTS audit_events_no_delete ON audit_events;
+UPDATE audit_events SET
+    before = (SELECT jsonb_object_agg(regexp_replace(key, '_before$', ''), value) FROM jsonb_each(after) WHERE key ~ '_before$'),
+    after = (SELECT jsonb_object_agg(regexp_replace(key, '_after$', ''), value) FROM jsonb_each(after) WHERE key !~ '_before$')
+WHERE before IS NULL AND EXISTS (SELECT 1 FROM jsonb_object_keys(after) AS k WHERE k ~ '_before$');
+
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only, % is not allowed', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+REVOKE UPDATE, DELETE, TRUNCATE ON audit_events FROM PUBLIC, CURRENT_USER;
+`,
+	// 12: attempts are counted before the password is checked, successful ones are taken back
+	`
+ALTER TABLE login_throttle ADD COLUMN IF NOT EXISTS previous_failure timestamptz;
+`,
+	// 13: events of a user are numbered by their own sequence under the lock of the user, so that they commit
+	// in the order of numbers. Old events keep their ids as numbers, streams resumed from them go on.
+	`
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS seq bigint;
+UPDATE order_events SET seq=id WHERE seq IS NULL;
+ALTER TABLE order_events ALTER COLUMN seq SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS order_events_user_seq_idx ON order_events (user_id, seq);
+`,
+	// 14: outbox events of a user are numbered the same way, old events are numbered in the order of ids
+	`
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS seq bigint;
+UPDATE outbox o SET seq=n.seq
+    FROM (SELECT id, row_number() OVER (PARTITION BY user_id ORDER BY id) AS seq FROM outbox) n
+    WHERE o.id=n.id AND o.seq IS NULL;
+ALTER TABLE outbox ALTER COLUMN seq SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS outbox_user_seq_idx ON outbox (user_id, seq);
+`,
+}
@@ -0,0 +1,24 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitScript(t *testing.T) {
+	statements := splitScript(Migrations[10])
+	assert.Len(t, statements, 7)
+	for _, q := range statements {
+		if strings.HasPrefix(q, "CREATE OR REPLACE FUNCTION") {
+			assert.True(t, strings.HasSuffix(q, "$$ LANGUAGE plpgsql"), "function body is kept whole: %s", q)
+		}
+	}
+
+	for i, m := range append([]string{CreateDB}, Migrations...) {
+		for _, q := range splitScript(m) {
+			assert.Equal(t, 0, strings.Count(q, "$$")%2, "migration %d has unbalanced $$: %s", i, q)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// SelectStats counts orders waiting for accrual and sums the ledger, the sum scans processed orders
+// so the result is cached by the caller
+func (db *PGDB) SelectStats(ctx context.Context) (models.Stats, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	stats := models.Stats{Ledger: make(map[string]int64)}
+	err := db.Conn.QueryRow(ctx, `SELECT COUNT(*) FROM bonuses WHERE status NOT IN ('PROCESSED', 'INVALID')`).
+		Scan(&stats.PendingOrders)
+	if err != nil {
+		return stats, fmt.Errorf("count pending orders failed: %v", err)
+	}
+
+	rows, err := db.Conn.Query(ctx, `SELECT type, COALESCE(SUM(change), 0) FROM bonuses WHERE status='PROCESSED' GROUP BY type`)
+	if err != nil {
+		return stats, fmt.Errorf("select ledger totals failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var sum int64
+		if err := rows.Scan(&kind, &sum); err != nil {
+			return stats, fmt.Errorf("select ledger totals failed: %v", err)
+		}
+		stats.Ledger[kind] = sum
+	}
+
+	return stats, rows.Err()
+}
+
+// PoolStat tells how the connections of the pool are used, it is nil when the db is not connected through a pool
+func (db *PGDB) PoolStat() *pgxpool.Stat {
+	if pool, ok := db.Conn.(*pgxpool.Pool); ok {
+		return pool.Stat()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4"
+)
+
+// outboxLockID is the key of pg advisory lock held by the relay, only one relay works at a time
+// so that events of a user are published in the order they happened
+const outboxLockID = 20220727
+
+// insertOutbox records domain event, it has to be called in the same transaction which makes the change.
+// Event gets the next number of the user and its id under the lock of the user, so events of the user
+// commit in the order of their numbers and ids.
+func insertOutbox(ctx context.Context, tx pgx.Tx, p models.EventPayload) error {
+	payload, err := json.Marshal(&p)
+	if err != nil {
+		return fmt.Errorf("prepare event payload failed: %v", err)
+	}
+
+	if err := lockUser(ctx, tx, p.UserID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO outbox (user_id, seq, event, payload)
+								SELECT $1, COALESCE(MAX(seq), 0)+1, $2::varchar, $3::jsonb FROM outbox WHERE user_id=$1`,
+		p.UserID, p.Event, string(payload))
+	if err != nil {
+		return fmt.Errorf("insert into outbox failed: %v", err)
+	}
+
+	return nil
+}
+
+// ProcessOutbox gives up to limit oldest unpublished events to publish and marks as published the ids it returns.
+// Events of every user are given in the order of their numbers. If another relay holds the lock nothing is done.
+// Returns how many events were published.
+func (db *PGDB) ProcessOutbox(ctx context.Context, limit int, publish func([]models.DomainEvent) []int64) (int, error) {
+	var published []int64
+	err := db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			var locked bool
+			if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxLockID).Scan(&locked); err != nil {
+				return fmt.Errorf("lock outbox failed: %v", err)
+			} else if !locked {
+				return nil
+			}
+
+			row, err := tx.Query(ctx, `SELECT id, user_id, seq, event, payload::text, created_at FROM outbox
+											WHERE published_at IS NULL ORDER BY id LIMIT $1`, limit)
+			if err != nil {
+				return fmt.Errorf("init select from outbox failed: %v", err)
+			}
+			defer row.Close()
+
+			var list []models.DomainEvent
+			for row.Next() {
+				var ev models.DomainEvent
+				var payload string
+				if err := row.Scan(&ev.ID, &ev.UserID, &ev.Seq, &ev.Type, &payload, &ev.CreatedAt); err != nil {
+					return fmt.Errorf("select outbox failed: %v", err)
+				}
+				ev.Payload = json.RawMessage(payload)
+				list = append(list, ev)
+			}
+			if err := row.Err(); err != nil {
+				return fmt.Errorf("select outbox failed: %v", err)
+			}
+			row.Close()
+
+			if len(list) == 0 {
+				return nil
+			}
+			published = publish(list)
+			return nil
+		},
+		func(tx pgx.Tx) error {
+			if len(published) == 0 {
+				return nil
+			}
+			if _, err := tx.Exec(ctx, `UPDATE outbox SET published_at=current_timestamp WHERE id=ANY($1)`, published); err != nil {
+				return fmt.Errorf("mark outbox published failed: %v", err)
+			}
+			return nil
+		})
+
+	if err != nil {
+		return 0, fmt.Errorf("do with transaction failed: %w", err)
+	}
+
+	return len(published), nil
+}
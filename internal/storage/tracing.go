@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/tracing"
+)
+
+// tracedDB makes a span for every call of the db
+type tracedDB struct {
+	db DBinterface
+}
+
+// WithTracing wraps the db so that its methods are seen in traces of the requests
+func WithTracing(db DBinterface) DBinterface {
+	return tracedDB{db: db}
+}
+
+func (t tracedDB) CreateNewUser(ctx context.Context, u *models.User, audit models.AuditEvent) (int, error) {
+	ctx, span := tracing.Start(ctx, "storage.CreateNewUser")
+	id, err := t.db.CreateNewUser(ctx, u, audit)
+	tracing.End(span, err)
+	return id, err
+}
+
+func (t tracedDB) SelectPass(ctx context.Context, u *models.User) (*string, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectPass")
+	pass, err := t.db.SelectPass(ctx, u)
+	tracing.End(span, err)
+	return pass, err
+}
+
+func (t tracedDB) SelectBalance(ctx context.Context, user int64) (*models.Balance, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectBalance")
+	balance, err := t.db.SelectBalance(ctx, user)
+	tracing.End(span, err)
+	return balance, err
+}
+
+func (t tracedDB) InsertOrder(ctx context.Context, order models.Order, audit models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.InsertOrder")
+	err := t.db.InsertOrder(ctx, order, audit)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) InsertOrders(ctx context.Context, orders []models.Order, audit models.AuditEvent) ([]error, error) {
+	ctx, span := tracing.Start(ctx, "storage.InsertOrders")
+	errs, err := t.db.InsertOrders(ctx, orders, audit)
+	tracing.End(span, err)
+	return errs, err
+}
+
+// SelectOrdersForUpdate is not traced as it runs on every tick of the worker, the worker makes spans for batches
+// which are not empty
+func (t tracedDB) SelectOrdersForUpdate(ctx context.Context, cfg *config.Config, oin chan []models.Order, oout chan models.Order) {
+	t.db.SelectOrdersForUpdate(ctx, cfg, oin, oout)
+}
+
+func (t tracedDB) SelectAllOrders(ctx context.Context, user int64) ([]*models.Order, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectAllOrders")
+	orders, err := t.db.SelectAllOrders(ctx, user)
+	tracing.End(span, err)
+	return orders, err
+}
+
+func (t tracedDB) SelectOrders(ctx context.Context, user int64, filter models.OrderFilter) ([]*models.Order, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectOrders")
+	orders, err := t.db.SelectOrders(ctx, user, filter)
+	tracing.End(span, err)
+	return orders, err
+}
+
+func (t tracedDB) SelectOrder(ctx context.Context, number int64) (*models.Order, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectOrder")
+	order, err := t.db.SelectOrder(ctx, number)
+	tracing.End(span, err)
+	return order, err
+}
+
+func (t tracedDB) SelectAllWithdrawals(ctx context.Context, user int64) (*[]models.Withdrawal, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectAllWithdrawals")
+	withdrawals, err := t.db.SelectAllWithdrawals(ctx, user)
+	tracing.End(span, err)
+	return withdrawals, err
+}
+
+func (t tracedDB) SelectOrderEvents(ctx context.Context, user int64, after int64) ([]models.OrderEvent, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectOrderEvents")
+	events, err := t.db.SelectOrderEvents(ctx, user, after)
+	tracing.End(span, err)
+	return events, err
+}
+
+func (t tracedDB) CreateWebhook(ctx context.Context, hook *models.Webhook) error {
+	ctx, span := tracing.Start(ctx, "storage.CreateWebhook")
+	err := t.db.CreateWebhook(ctx, hook)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) SelectWebhooks(ctx context.Context, user int64) ([]models.Webhook, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectWebhooks")
+	hooks, err := t.db.SelectWebhooks(ctx, user)
+	tracing.End(span, err)
+	return hooks, err
+}
+
+func (t tracedDB) DeleteWebhook(ctx context.Context, user int64, id int64) error {
+	ctx, span := tracing.Start(ctx, "storage.DeleteWebhook")
+	err := t.db.DeleteWebhook(ctx, user, id)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) SelectWebhookDeliveries(ctx context.Context, user int64, id int64) ([]models.WebhookDelivery, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectWebhookDeliveries")
+	deliveries, err := t.db.SelectWebhookDeliveries(ctx, user, id)
+	tracing.End(span, err)
+	return deliveries, err
+}
+
+func (t tracedDB) ClaimWebhookMessages(ctx context.Context, limit int) ([]models.WebhookMessage, error) {
+	ctx, span := tracing.Start(ctx, "storage.ClaimWebhookMessages")
+	messages, err := t.db.ClaimWebhookMessages(ctx, limit)
+	tracing.End(span, err)
+	return messages, err
+}
+
+func (t tracedDB) RecordWebhookDelivery(ctx context.Context, d models.WebhookDelivery, delivered bool, next time.Time) error {
+	ctx, span := tracing.Start(ctx, "storage.RecordWebhookDelivery")
+	err := t.db.RecordWebhookDelivery(ctx, d, delivered, next)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) EnqueueWebhooks(ctx context.Context, ev models.DomainEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.EnqueueWebhooks")
+	err := t.db.EnqueueWebhooks(ctx, ev)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) ProcessOutbox(ctx context.Context, limit int, publish func([]models.DomainEvent) []int64) (int, error) {
+	ctx, span := tracing.Start(ctx, "storage.ProcessOutbox")
+	n, err := t.db.ProcessOutbox(ctx, limit, publish)
+	tracing.End(span, err)
+	return n, err
+}
+
+func (t tracedDB) SelectUserAccess(ctx context.Context, user int64) (string, bool, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectUserAccess")
+	role, blocked, err := t.db.SelectUserAccess(ctx, user)
+	tracing.End(span, err)
+	return role, blocked, err
+}
+
+func (t tracedDB) SearchUsers(ctx context.Context, q string, limit int) ([]models.UserInfo, error) {
+	ctx, span := tracing.Start(ctx, "storage.SearchUsers")
+	users, err := t.db.SearchUsers(ctx, q, limit)
+	tracing.End(span, err)
+	return users, err
+}
+
+func (t tracedDB) SelectUser(ctx context.Context, user int64) (*models.UserInfo, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectUser")
+	info, err := t.db.SelectUser(ctx, user)
+	tracing.End(span, err)
+	return info, err
+}
+
+func (t tracedDB) SelectLedger(ctx context.Context, user int64) ([]models.LedgerEntry, error) {
+	ctx, span := tracing.Start(ctx, "storage.SelectLedger")
+	ledger, err := t.db.SelectLedger(ctx, user)
+	tracing.End(span, err)
+	return ledger, err
+}
+
+func (t tracedDB) AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.AdjustBalance")
+	err := t.db.AdjustBalance(ctx, adj, audit)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) SetUserBlocked(ctx context.Context, user int64, blocked bool, audit models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.SetUserBlocked")
+	err := t.db.SetUserBlocked(ctx, user, blocked, audit)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) SetUserRole(ctx context.Context, user int64, role string, audit models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.SetUserRole")
+	err := t.db.SetUserRole(ctx, user, role, audit)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) RequeueOrder(ctx context.Context, number int64, audit models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.RequeueOrder")
+	err := t.db.RequeueOrder(ctx, number, audit)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) InsertAudit(ctx context.Context, ev models.AuditEvent) error {
+	ctx, span := tracing.Start(ctx, "storage.InsertAudit")
+	err := t.db.InsertAudit(ctx, ev)
+	tracing.End(span, err)
+	return err
+}
+
+func (t tracedDB) ExportAudit(ctx context.Context, f models.AuditFilter, fn func(models.AuditEvent) error) error {
+	ctx, span := tracing.Start(ctx, "storage.ExportAudit")
+	err := t.db.ExportAudit(ctx, f, fn)
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/jackc/pgx/v4"
+)
+
+// webhookLease is how long a claimed message is not given to other senders,
+// if sender dies in the middle the message is retried after that
+const webhookLease = 5 * time.Minute
+
+// ErrWebhookNotFound is returned when user has no webhook with such id
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// EnqueueWebhooks puts domain event to the outbox of every webhook of the user subscribed to it,
+// the same event is enqueued only once even if it is published again
+func (db *PGDB) EnqueueWebhooks(ctx context.Context, ev models.DomainEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := db.Conn.Exec(ctx, `INSERT INTO webhook_outbox (webhook_id, event_id, event, payload)
+								SELECT id, $2, $3::text, $4::jsonb FROM webhooks WHERE user_id=$1 AND $3::text=ANY(events)
+								ON CONFLICT (webhook_id, event_id) DO NOTHING`,
+		ev.UserID, ev.ID, ev.Type, string(ev.Payload))
+	if err != nil {
+		return fmt.Errorf("insert into webhook outbox failed: %v", err)
+	}
+
+	return nil
+}
+
+// CreateWebhook saves new webhook of the user
+func (db *PGDB) CreateWebhook(ctx context.Context, w *models.Webhook) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	err := db.Conn.QueryRow(ctx, `INSERT INTO webhooks (user_id, url, secret, events) VALUES($1,$2,$3,$4) RETURNING id, created_at`,
+		w.UserID, w.URL, w.Secret, w.Events).Scan(&w.ID, &w.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert webhook failed: %v", err)
+	}
+
+	return nil
+}
+
+// SelectWebhooks gets all webhooks of the user, secrets are not selected
+func (db *PGDB) SelectWebhooks(ctx context.Context, u int64) ([]models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	row, err := db.Conn.Query(ctx, `SELECT id, user_id, url, events, created_at FROM webhooks WHERE user_id=$1 ORDER BY id`, u)
+	if err != nil {
+		return nil, fmt.Errorf("init select from webhooks failed: %v", err)
+	}
+	defer row.Close()
+
+	var list []models.Webhook
+	for row.Next() {
+		var w models.Webhook
+		if err := row.Scan(&w.ID, &w.UserID, &w.URL, &w.Events, &w.CreatedAt); err != nil {
+			return nil, fmt.Errorf("select webhooks failed: %v", err)
+		}
+		list = append(list, w)
+	}
+
+	return list, row.Err()
+}
+
+// DeleteWebhook removes webhook of the user together with its undelivered messages
+func (db *PGDB) DeleteWebhook(ctx context.Context, u int64, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	tag, err := db.Conn.Exec(ctx, `DELETE FROM webhooks WHERE id=$1 AND user_id=$2`, id, u)
+	if err != nil {
+		return fmt.Errorf("delete webhook failed: %v", err)
+	} else if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// SelectWebhookDeliveries gets last delivery attempts of user's webhook
+func (db *PGDB) SelectWebhookDeliveries(ctx context.Context, u int64, id int64) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var exists bool
+	if err := db.Conn.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM webhooks WHERE id=$1 AND user_id=$2)`, id, u).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("select webhook failed: %v", err)
+	} else if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	row, err := db.Conn.Query(ctx, `SELECT d.id, d.outbox_id, o.event, d.attempt, COALESCE(d.status_code, 0), COALESCE(d.error, ''),
+										d.duration_ms, d.created_at
+									FROM webhook_deliveries d JOIN webhook_outbox o ON o.id=d.outbox_id
+									WHERE o.webhook_id=$1 ORDER BY d.id DESC LIMIT 100`, id)
+	if err != nil {
+		return nil, fmt.Errorf("init select from webhook deliveries failed: %v", err)
+	}
+	defer row.Close()
+
+	var list []models.WebhookDelivery
+	for row.Next() {
+		var d models.WebhookDelivery
+		if err := row.Scan(&d.ID, &d.MessageID, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.Duration, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("select webhook deliveries failed: %v", err)
+		}
+		list = append(list, d)
+	}
+
+	return list, row.Err()
+}
+
+// ClaimWebhookMessages takes messages which are due to be sent and hides them from other senders for webhookLease
+func (db *PGDB) ClaimWebhookMessages(ctx context.Context, limit int) ([]models.WebhookMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	row, err := db.Conn.Query(ctx, `UPDATE webhook_outbox o SET next_attempt_at=current_timestamp+$2::int*interval '1 second'
+										FROM webhooks w
+										WHERE w.id=o.webhook_id AND o.id IN (
+											SELECT id FROM webhook_outbox
+											WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at<=current_timestamp
+											ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED)
+										RETURNING o.id, o.event, o.payload::text, w.url, w.secret, o.attempts`,
+		limit, int(webhookLease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("init claim webhook messages failed: %v", err)
+	}
+	defer row.Close()
+
+	var list []models.WebhookMessage
+	for row.Next() {
+		var m models.WebhookMessage
+		var payload string
+		if err := row.Scan(&m.ID, &m.Event, &payload, &m.URL, &m.Secret, &m.Attempts); err != nil {
+			return nil, fmt.Errorf("claim webhook messages failed: %v", err)
+		}
+		m.Payload = []byte(payload)
+		list = append(list, m)
+	}
+
+	return list, row.Err()
+}
+
+// RecordWebhookDelivery logs delivery attempt and schedules the message, zero retryAt
+// of a not delivered message means no more attempts will be made
+func (db *PGDB) RecordWebhookDelivery(ctx context.Context, d models.WebhookDelivery, delivered bool, retryAt time.Time) error {
+	return db.doAsTransaction(ctx,
+		func(tx pgx.Tx) error {
+			var statusCode *int
+			if d.StatusCode != 0 {
+				statusCode = &d.StatusCode
+			}
+			var deliveryErr *string
+			if d.Error != "" {
+				deliveryErr = &d.Error
+			}
+
+			_, err := tx.Exec(ctx, `INSERT INTO webhook_deliveries (outbox_id, attempt, status_code, error, duration_ms) VALUES($1,$2,$3,$4,$5)`,
+				d.MessageID, d.Attempt, statusCode, deliveryErr, d.Duration)
+			if err != nil {
+				return fmt.Errorf("insert webhook delivery failed: %v", err)
+			}
+			return nil
+		},
+		func(tx pgx.Tx) error {
+			var err error
+			switch {
+			case delivered:
+				_, err = tx.Exec(ctx, `UPDATE webhook_outbox SET attempts=$2, delivered_at=current_timestamp WHERE id=$1`, d.MessageID, d.Attempt)
+			case retryAt.IsZero():
+				_, err = tx.Exec(ctx, `UPDATE webhook_outbox SET attempts=$2, failed_at=current_timestamp WHERE id=$1`, d.MessageID, d.Attempt)
+			default:
+				_, err = tx.Exec(ctx, `UPDATE webhook_outbox SET attempts=$2, next_attempt_at=$3 WHERE id=$1`, d.MessageID, d.Attempt, retryAt)
+			}
+			if err != nil {
+				return fmt.Errorf("update webhook outbox failed: %v", err)
+			}
+			return nil
+		})
+}
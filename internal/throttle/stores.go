@@ -0,0 +1,195 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/jackc/pgx/v4"
+)
+
+// pruneEvery is how many failures are counted between removals of forgotten records
+const pruneEvery = 1000
+
+// MemoryStore keeps records in the process, counters are not shared between instances
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*memRecord
+	fails   int
+}
+
+type memRecord struct {
+	Record
+	forget   time.Duration
+	previous time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*memRecord)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		return r.Record, nil
+	}
+	return Record{}, nil
+}
+
+func (s *MemoryStore) Fail(ctx context.Context, key string, now time.Time, forget time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fails++
+	if s.fails%pruneEvery == 0 {
+		for k, r := range s.records {
+			if now.Sub(r.LastFailure) > r.forget && now.After(r.LockedUntil) {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	r, ok := s.records[key]
+	if !ok {
+		r = &memRecord{}
+		s.records[key] = r
+	}
+	if now.Sub(r.LastFailure) > forget {
+		r.Failures = 0
+	}
+	before := r.Record
+	r.Failures++
+	r.previous, r.LastFailure = r.LastFailure, now
+	r.forget = forget
+	return before, nil
+}
+
+func (s *MemoryStore) Refund(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok && r.Failures > 0 {
+		r.Failures--
+		r.LastFailure = r.previous
+	}
+	return nil
+}
+
+func (s *MemoryStore) Lock(ctx context.Context, key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok {
+		r.LockedUntil = until
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
+
+// PGStore keeps records in login_throttle table, so that all instances share the counters
+type PGStore struct {
+	conn  storage.PGinterface
+	fails int64
+}
+
+func NewPGStore(conn storage.PGinterface) *PGStore {
+	return &PGStore{conn: conn}
+}
+
+func (s *PGStore) Get(ctx context.Context, key string) (Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var r Record
+	var locked *time.Time
+	err := s.conn.QueryRow(ctx, `SELECT failures, last_failure, locked_until FROM login_throttle WHERE key=$1`, key).
+		Scan(&r.Failures, &r.LastFailure, &locked)
+	if err == pgx.ErrNoRows {
+		return Record{}, nil
+	} else if err != nil {
+		return Record{}, fmt.Errorf("select login throttle failed: %v", err)
+	}
+	if locked != nil {
+		r.LockedUntil = *locked
+	}
+	return r, nil
+}
+
+func (s *PGStore) Fail(ctx context.Context, key string, now time.Time, forget time.Duration) (Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if atomic.AddInt64(&s.fails, 1)%pruneEvery == 0 {
+		_, err := s.conn.Exec(ctx, `DELETE FROM login_throttle WHERE last_failure < $1 AND (locked_until IS NULL OR locked_until < $2)`,
+			now.Add(-forget), now)
+		if err != nil {
+			return Record{}, fmt.Errorf("prune login throttle failed: %v", err)
+		}
+	}
+
+	// values of the row before the update are kept in previous_failure and derived from the counter
+	var r Record
+	var locked, previous *time.Time
+	err := s.conn.QueryRow(ctx, `INSERT INTO login_throttle (key, failures, last_failure) VALUES($1, 1, $2)
+								ON CONFLICT (key) DO UPDATE SET
+									failures = CASE WHEN login_throttle.last_failure < $3 THEN 1 ELSE login_throttle.failures + 1 END,
+									previous_failure = login_throttle.last_failure,
+									last_failure = $2
+								RETURNING failures, previous_failure, locked_until`, key, now, now.Add(-forget)).
+		Scan(&r.Failures, &previous, &locked)
+	if err != nil {
+		return Record{}, fmt.Errorf("count login failure failed: %v", err)
+	}
+	r.Failures--
+	if previous != nil && r.Failures > 0 {
+		r.LastFailure = *previous
+	}
+	if locked != nil {
+		r.LockedUntil = *locked
+	}
+	return r, nil
+}
+
+func (s *PGStore) Refund(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := s.conn.Exec(ctx, `UPDATE login_throttle SET failures=GREATEST(failures-1, 0),
+									last_failure=COALESCE(previous_failure, last_failure) WHERE key=$1`, key)
+	if err != nil {
+		return fmt.Errorf("refund login attempt failed: %v", err)
+	}
+	return nil
+}
+
+func (s *PGStore) Lock(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := s.conn.Exec(ctx, `UPDATE login_throttle SET locked_until=$2 WHERE key=$1`, key, until); err != nil {
+		return fmt.Errorf("lock login failed: %v", err)
+	}
+	return nil
+}
+
+func (s *PGStore) Reset(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := s.conn.Exec(ctx, `DELETE FROM login_throttle WHERE key=$1`, key); err != nil {
+		return fmt.Errorf("reset login throttle failed: %v", err)
+	}
+	return nil
+}
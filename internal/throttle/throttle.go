@@ -0,0 +1,167 @@
+// Package throttle slows down password guessing. Failed logins are counted per login and per client IP,
+// after a few free attempts every next one has to wait longer, and too many failures lock the key for a while.
+package throttle
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Record is the state of one key, e.g. "login:alice" or "ip:203.0.113.7"
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Store keeps records, Fail has to be atomic as many attempts for the same key can come at once
+type Store interface {
+	Get(ctx context.Context, key string) (Record, error)
+	// Fail counts the failure at now and returns the record as it was before it, counting starts over
+	// when the last failure is older than forget
+	Fail(ctx context.Context, key string, now time.Time, forget time.Duration) (Record, error)
+	// Refund takes back the last counted failure
+	Refund(ctx context.Context, key string) error
+	Lock(ctx context.Context, key string, until time.Time) error
+	Reset(ctx context.Context, key string) error
+}
+
+// Policy sets how fast the attempts slow down
+type Policy struct {
+	// Free is how many failures are allowed without delay
+	Free int
+	// Delay is the wait after the first failure above Free, it doubles with every next one up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// LockAfter failures lock the key for LockFor
+	LockAfter int
+	LockFor   time.Duration
+	// Forget is the time without failures after which the key is clean again
+	Forget time.Duration
+}
+
+var (
+	// DefaultLoginPolicy protects one account
+	DefaultLoginPolicy = Policy{Free: 3, Delay: time.Second, MaxDelay: 30 * time.Second, LockAfter: 10, LockFor: 15 * time.Minute,
+		Forget: time.Hour}
+	// DefaultIPPolicy is softer as many users can be behind one address
+	DefaultIPPolicy = Policy{Free: 10, Delay: time.Second, MaxDelay: 30 * time.Second, LockAfter: 50, LockFor: 15 * time.Minute,
+		Forget: time.Hour}
+)
+
+// wait tells how long the key has to wait before the next attempt
+func (p Policy) wait(r Record, now time.Time) time.Duration {
+	if now.Before(r.LockedUntil) {
+		return r.LockedUntil.Sub(now)
+	}
+	if r.Failures <= p.Free || now.Sub(r.LastFailure) > p.Forget {
+		return 0
+	}
+
+	delay := p.Delay
+	for i := p.Free + 1; i < r.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if next := r.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Limiter checks login attempts against both policies
+type Limiter struct {
+	store Store
+	login Policy
+	ip    Policy
+	now   func() time.Time
+}
+
+func New(store Store, login Policy, ip Policy) *Limiter {
+	return &Limiter{store: store, login: login, ip: ip, now: time.Now}
+}
+
+// keys of the attempt with their policies, attempt without known IP is counted only for the login
+func (l *Limiter) keys(login string, ip string) map[string]Policy {
+	keys := map[string]Policy{"login:" + strings.ToLower(login): l.login}
+	if ip != "" {
+		keys["ip:"+ip] = l.ip
+	}
+	return keys
+}
+
+// Attempt counts the attempt as failed before the password is checked and returns how long the client has to wait,
+// zero means the attempt is allowed. Counting first makes concurrent attempts see each other, so that a burst
+// of guesses does not pass at once. Attempts made while waiting are counted too. The result of the allowed attempt
+// is reported with Failure, Success or Cancel.
+func (l *Limiter) Attempt(ctx context.Context, login string, ip string) (time.Duration, error) {
+	now := l.now()
+	var wait time.Duration
+	for key, p := range l.keys(login, ip) {
+		r, err := l.store.Fail(ctx, key, now, p.Forget)
+		if err != nil {
+			return 0, err
+		}
+		if w := p.wait(r, now); w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// Failure locks the login or the IP when the failed attempt is one too many and tells whether it did
+func (l *Limiter) Failure(ctx context.Context, login string, ip string) (bool, error) {
+	now := l.now()
+	locked := false
+	for key, p := range l.keys(login, ip) {
+		r, err := l.store.Get(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if r.Failures >= p.LockAfter && !now.Before(r.LockedUntil) {
+			if err := l.store.Lock(ctx, key, now.Add(p.LockFor)); err != nil {
+				return false, err
+			}
+			locked = true
+		}
+	}
+	return locked, nil
+}
+
+// Success forgets failures of the login, failures of the IP stay as one valid account should not
+// let to guess passwords of others, only the successful attempt is taken back
+func (l *Limiter) Success(ctx context.Context, login string, ip string) error {
+	if err := l.store.Reset(ctx, "login:"+strings.ToLower(login)); err != nil {
+		return err
+	}
+	if ip != "" {
+		return l.store.Refund(ctx, "ip:"+ip)
+	}
+	return nil
+}
+
+// Cancel takes back the attempt which has not been decided, e.g. when the db has failed
+func (l *Limiter) Cancel(ctx context.Context, login string, ip string) error {
+	for key := range l.keys(login, ip) {
+		if err := l.store.Refund(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unlock forgets failures and lockout of the login and of the IP, empty ones are skipped
+func (l *Limiter) Unlock(ctx context.Context, login string, ip string) error {
+	if login != "" {
+		if err := l.store.Reset(ctx, "login:"+strings.ToLower(login)); err != nil {
+			return err
+		}
+	}
+	if ip != "" {
+		return l.store.Reset(ctx, "ip:"+ip)
+	}
+	return nil
+}
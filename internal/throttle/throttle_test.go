@@ -0,0 +1,132 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_wait(t *testing.T) {
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	p := Policy{Free: 3, Delay: time.Second, MaxDelay: 8 * time.Second, LockAfter: 10, LockFor: time.Minute, Forget: time.Hour}
+	tests := []struct {
+		name   string
+		record Record
+		want   time.Duration
+	}{
+		{name: "clean",
+			want: 0,
+		},
+		{name: "free_attempts",
+			record: Record{Failures: 3, LastFailure: now},
+			want:   0,
+		},
+		{name: "first_delay",
+			record: Record{Failures: 4, LastFailure: now},
+			want:   time.Second,
+		},
+		{name: "delay_doubles",
+			record: Record{Failures: 6, LastFailure: now},
+			want:   4 * time.Second,
+		},
+		{name: "delay_is_capped",
+			record: Record{Failures: 9, LastFailure: now},
+			want:   8 * time.Second,
+		},
+		{name: "delay_passed",
+			record: Record{Failures: 6, LastFailure: now.Add(-5 * time.Second)},
+			want:   0,
+		},
+		{name: "locked",
+			record: Record{Failures: 10, LastFailure: now, LockedUntil: now.Add(time.Minute)},
+			want:   time.Minute,
+		},
+		{name: "forgotten",
+			record: Record{Failures: 9, LastFailure: now.Add(-2 * time.Hour)},
+			want:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, p.wait(tt.record, now))
+		})
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, 8, 1, 12, 0, 0, 0, time.UTC)
+	p := Policy{Free: 1, Delay: time.Second, MaxDelay: time.Second, LockAfter: 3, LockFor: time.Minute, Forget: time.Hour}
+	store := NewMemoryStore()
+	l := New(store, p, Policy{Free: 100, LockAfter: 100, Forget: time.Hour})
+	l.now = func() time.Time { return now }
+
+	fail := func(login string, ip string) (time.Duration, bool) {
+		wait, err := l.Attempt(ctx, login, ip)
+		require.NoError(t, err)
+		if wait > 0 {
+			return wait, false
+		}
+		locked, err := l.Failure(ctx, login, ip)
+		require.NoError(t, err)
+		return 0, locked
+	}
+
+	wait, locked := fail("Alice", "203.0.113.7")
+	assert.Zero(t, wait)
+	assert.False(t, locked)
+	wait, _ = fail("alice", "198.51.100.1")
+	assert.Zero(t, wait)
+	wait, _ = fail("alice", "198.51.100.1")
+	assert.Equal(t, time.Second, wait, "login is throttled from any IP")
+
+	now = now.Add(2 * time.Second)
+	wait, locked = fail("alice", "203.0.113.7")
+	assert.Zero(t, wait)
+	assert.True(t, locked)
+	wait, _ = fail("alice", "203.0.113.7")
+	assert.Equal(t, time.Minute, wait)
+
+	require.NoError(t, l.Unlock(ctx, "ALICE", ""))
+	wait, err := l.Attempt(ctx, "alice", "203.0.113.7")
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+	ip, err := store.Get(ctx, "ip:203.0.113.7")
+	require.NoError(t, err)
+	require.NoError(t, l.Success(ctx, "alice", "203.0.113.7"))
+	after, err := store.Get(ctx, "ip:203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, ip.Failures-1, after.Failures, "successful attempt is not a failure of the IP")
+	r, err := store.Get(ctx, "login:alice")
+	require.NoError(t, err)
+	assert.Zero(t, r.Failures)
+}
+
+func TestLimiter_Burst(t *testing.T) {
+	ctx := context.Background()
+	p := Policy{Free: 1, Delay: time.Minute, MaxDelay: time.Minute, LockAfter: 10, LockFor: time.Hour, Forget: time.Hour}
+	store := NewMemoryStore()
+	l := New(store, p, DefaultIPPolicy)
+
+	// all guesses arrive before the first of them is found wrong
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		wait, err := l.Attempt(ctx, "bob", "203.0.113.7")
+		require.NoError(t, err)
+		if wait == 0 {
+			allowed++
+		}
+	}
+	assert.Equal(t, p.Free+1, allowed)
+
+	// the attempt which has not been decided is not a failure
+	r, err := store.Get(ctx, "login:bob")
+	require.NoError(t, err)
+	require.NoError(t, l.Cancel(ctx, "bob", "203.0.113.7"))
+	after, err := store.Get(ctx, "login:bob")
+	require.NoError(t, err)
+	assert.Equal(t, r.Failures-1, after.Failures)
+}
@@ -0,0 +1,115 @@
+// Package tracing sets up OpenTelemetry traces. Spans are made for HTTP routes, storage methods and requests
+// to the accrual system, trace context is taken from and passed on in W3C traceparent headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/GoSeoTaxi/t1/internal/observe"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/GoSeoTaxi/t1"
+
+// Init sets the global tracer provider with the exporter:
+//   - "otlp" sends spans to the collector set by OTEL_EXPORTER_OTLP_ENDPOINT (localhost:4317 by default)
+//   - "stdout" prints them
+//   - "file" writes them to the file
+//   - "off" or empty turns tracing off
+//
+// Trace context is propagated in any case, so that the service does not break traces of its clients.
+// Returned function flushes spans which are not yet exported, it has to be called before exit.
+func Init(ctx context.Context, exporter string, file string, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var out io.Closer
+	var err error
+	switch exporter {
+	case "otlp":
+		exp, err = otlptracegrpc.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		var f *os.File
+		if f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return nil, fmt.Errorf("cannot open traces file: %v", err)
+		}
+		out = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case "", "off":
+		return func(context.Context) error { return nil }, nil
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create traces exporter: %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if out != nil {
+			out.Close()
+		}
+		return err
+	}, nil
+}
+
+// OrderNumber is set on spans dealing with one order, traces of the order are found by it
+func OrderNumber(n int64) attribute.KeyValue {
+	return attribute.Int64("order.number", n)
+}
+
+// Start begins the span as a child of the span in ctx
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// End finishes the span and marks it failed when there is an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// HTTP makes a span for every request, its name is the chi route pattern which is known only after routing
+func HTTP(next http.Handler) http.Handler {
+	named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if route := observe.Route(r); route != "" {
+			span := trace.SpanFromContext(r.Context())
+			span.SetName(r.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRouteKey.String(route))
+		}
+	})
+	return otelhttp.NewHandler(named, "HTTP", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method
+	}))
+}
+
+// Transport passes trace context in outgoing requests and makes a span for each of them
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
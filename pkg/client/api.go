@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+}
+
+// Register creates a user and logs the client in
+func (c *Client) Register(ctx context.Context, login, password string) error {
+	body, err := json.Marshal(credentials{Login: login, Password: password})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{method: http.MethodPost, path: "/api/user/register", contentType: "application/json", body: body})
+	return err
+}
+
+// Login authenticates the user, the token is kept by the client. It is not repeated on failures: every attempt
+// counts against the login throttle, and ErrTooManyAttempts has to reach the caller.
+func (c *Client) Login(ctx context.Context, login, password string) error {
+	body, err := json.Marshal(credentials{Login: login, Password: password})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{method: http.MethodPost, path: "/api/user/login", contentType: "application/json", body: body})
+	return err
+}
+
+// UploadOrder sends order number for accrual calculation. It returns true when the order is new
+// and false when the user has already uploaded it.
+func (c *Client) UploadOrder(ctx context.Context, number string) (bool, error) {
+	resp, err := c.do(ctx, request{method: http.MethodPost, path: "/api/user/orders", contentType: "text/plain", body: []byte(number), idempotent: true})
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusAccepted, nil
+}
+
+// ListOrders returns orders uploaded by the user, with nil params all of them are returned at once
+func (c *Client) ListOrders(ctx context.Context, params *ListOrdersParams) (*OrdersPage, error) {
+	path := "/api/user/orders"
+	if q := params.query(); len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: path, idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &OrdersPage{NextCursor: resp.Header.Get("X-Next-Cursor")}
+	if resp.StatusCode == http.StatusNoContent {
+		return page, nil
+	}
+	if err := json.Unmarshal(resp.body, &page.Orders); err != nil {
+		return nil, fmt.Errorf("orders cannot be decoded: %w", err)
+	}
+	return page, nil
+}
+
+func (p *ListOrdersParams) query() url.Values {
+	q := url.Values{}
+	if p == nil {
+		return q
+	}
+	if p.Limit > 0 {
+		q.Set("limit", strconv.Itoa(p.Limit))
+	}
+	if p.Cursor != "" {
+		q.Set("cursor", p.Cursor)
+	}
+	if len(p.Statuses) > 0 {
+		q.Set("status", strings.Join(p.Statuses, ","))
+	}
+	if p.Type != "" {
+		q.Set("type", p.Type)
+	}
+	if !p.From.IsZero() {
+		q.Set("from", p.From.Format(time.RFC3339))
+	}
+	if !p.To.IsZero() {
+		q.Set("to", p.To.Format(time.RFC3339))
+	}
+	if p.Desc {
+		q.Set("sort", "desc")
+	}
+	return q
+}
+
+// Balance returns current balance of the user
+func (c *Client) Balance(ctx context.Context) (*Balance, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/balance", idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var b Balance
+	if err := json.Unmarshal(resp.body, &b); err != nil {
+		return nil, fmt.Errorf("balance cannot be decoded: %w", err)
+	}
+	return &b, nil
+}
+
+// Withdraw pays for the order with bonuses. It is not repeated on failures, since the order
+// number can be used once, repeated call after a lost response fails with ErrOrderNumberUsed.
+func (c *Client) Withdraw(ctx context.Context, order string, sum float64) error {
+	body, err := json.Marshal(struct {
+		Order string  `json:"order"`
+		Sum   float64 `json:"sum"`
+	}{order, sum})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, request{method: http.MethodPost, path: "/api/user/balance/withdraw", contentType: "application/json", body: body})
+	return err
+}
+
+// Withdrawals returns all withdrawals of the user
+func (c *Client) Withdrawals(ctx context.Context) ([]Withdrawal, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/withdrawals", idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var ws []Withdrawal
+	if err := json.Unmarshal(resp.body, &ws); err != nil {
+		return nil, fmt.Errorf("withdrawals cannot be decoded: %w", err)
+	}
+	return ws, nil
+}
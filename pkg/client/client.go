@@ -0,0 +1,250 @@
+// Package client is a typed client of the gophermart HTTP API
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 200 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Client calls the API on behalf of one user, token received by Register or Login
+// is kept and sent with every next request
+type Client struct {
+	baseURL string
+	http    *http.Client
+	retries int
+	backoff time.Duration
+	gzip    bool
+
+	mu    sync.Mutex
+	token string
+}
+
+// Option changes optional settings of the client
+type Option func(*Client)
+
+// WithHTTPClient sets http client used for requests
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) {
+		cl.http = c
+	}
+}
+
+// WithRetries sets how many times a failed idempotent request is repeated and the initial pause
+// between attempts, which is doubled after each of them
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(cl *Client) {
+		cl.retries = retries
+		cl.backoff = backoff
+	}
+}
+
+// WithToken sets jwt of an already logged in user
+func WithToken(token string) Option {
+	return func(cl *Client) {
+		cl.token = token
+	}
+}
+
+// WithGzip turns on compression of request bodies
+func WithGzip(enabled bool) Option {
+	return func(cl *Client) {
+		cl.gzip = enabled
+	}
+}
+
+// New creates client of the API running at baseURL, e.g. http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Token returns jwt of the logged in user, it can be saved and passed to WithToken later
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+func (c *Client) setToken(resp *http.Response) {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "jwt" {
+			c.mu.Lock()
+			c.token = cookie.Value
+			c.mu.Unlock()
+		}
+	}
+}
+
+// request describes one API call
+type request struct {
+	method      string
+	path        string
+	contentType string
+	body        []byte
+	// idempotent requests are repeated on network errors and 5xx or 429 responses
+	idempotent bool
+}
+
+// response is a successful response with decompressed body
+type response struct {
+	*http.Response
+	body []byte
+}
+
+func (c *Client) do(ctx context.Context, req request) (*response, error) {
+	attempts := 1
+	if req.idempotent {
+		attempts += c.retries
+	}
+
+	backoff := c.backoff
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+
+		var resp *response
+		var wait time.Duration
+		resp, wait, err = c.send(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		if !retryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		if wait > backoff {
+			backoff = wait
+		}
+	}
+	return nil, err
+}
+
+// send makes one attempt, pause requested by the server with Retry-After is returned with the error
+func (c *Client) send(ctx context.Context, req request) (*response, time.Duration, error) {
+	body, err := c.encodeBody(req.body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, req.method, c.baseURL+req.path, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	if req.contentType != "" {
+		r.Header.Set("Content-Type", req.contentType)
+		if c.gzip {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+	}
+	r.Header.Set("Accept-Encoding", "gzip")
+	if token := c.Token(); token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return nil, 0, &netError{err}
+	}
+	defer resp.Body.Close()
+
+	data, err := readBody(resp)
+	if err != nil {
+		return nil, 0, &netError{err}
+	}
+
+	if resp.StatusCode >= 400 {
+		wait := time.Duration(0)
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(s) * time.Second
+		}
+		return nil, wait, decodeError(resp, data)
+	}
+
+	c.setToken(resp)
+	return &response{Response: resp, body: data}, 0, nil
+}
+
+func (c *Client) encodeBody(b []byte) (io.Reader, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if !c.gzip {
+		return bytes.NewReader(b), nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var r io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("response is not valid gzip: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return io.ReadAll(r)
+}
+
+// netError is a failure to get a response from the server
+type netError struct {
+	err error
+}
+
+func (e *netError) Error() string { return "gophermart: " + e.err.Error() }
+
+func (e *netError) Unwrap() error { return e.err }
+
+func retryable(err error) bool {
+	var ne *netError
+	if errors.As(err, &ne) {
+		return true
+	}
+	var ae *Error
+	return errors.As(err, &ae) && (ae.StatusCode >= 500 || ae.StatusCode == http.StatusTooManyRequests)
+}
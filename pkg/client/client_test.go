@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoSeoTaxi/t1/internal/app"
+	"github.com/GoSeoTaxi/t1/internal/config"
+	"github.com/GoSeoTaxi/t1/internal/handlers"
+	"github.com/GoSeoTaxi/t1/internal/models"
+	"github.com/GoSeoTaxi/t1/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newServer(t *testing.T, wrap func(http.Handler) http.Handler) *httptest.Server {
+	var h http.Handler = handlers.BonusRouter(context.Background(), newMemDB(), app.NewTokenAuth("test"), zap.NewNop())
+	if wrap != nil {
+		h = wrap(h)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "gzip"}[gz], func(t *testing.T) {
+			ctx := context.Background()
+			srv := newServer(t, nil)
+			c := New(srv.URL, WithGzip(gz))
+
+			_, err := c.Balance(ctx)
+			assert.ErrorIs(t, err, ErrUnauthorized)
+
+			require.NoError(t, c.Register(ctx, "user", "pass"))
+			assert.NotEmpty(t, c.Token())
+			assert.ErrorIs(t, New(srv.URL).Register(ctx, "user", "pass"), ErrLoginTaken)
+			assert.ErrorIs(t, New(srv.URL).Login(ctx, "user", "wrong"), ErrWrongCredentials)
+
+			accepted, err := c.UploadOrder(ctx, "12345678903")
+			require.NoError(t, err)
+			assert.True(t, accepted)
+			accepted, err = c.UploadOrder(ctx, "12345678903")
+			require.NoError(t, err)
+			assert.False(t, accepted)
+			_, err = c.UploadOrder(ctx, "12345678901")
+			assert.ErrorIs(t, err, ErrInvalidOrderNumber)
+
+			other := New(srv.URL, WithGzip(gz))
+			require.NoError(t, other.Register(ctx, "other", "pass"))
+			_, err = other.UploadOrder(ctx, "12345678903")
+			assert.ErrorIs(t, err, ErrOrderConflict)
+
+			page, err := c.ListOrders(ctx, nil)
+			require.NoError(t, err)
+			require.Len(t, page.Orders, 1)
+			assert.Equal(t, "12345678903", page.Orders[0].Number)
+			assert.Equal(t, StatusNew, page.Orders[0].Status)
+
+			page, err = other.ListOrders(ctx, &ListOrdersParams{Limit: 10})
+			require.NoError(t, err)
+			assert.Empty(t, page.Orders)
+
+			b, err := c.Balance(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, Balance{Current: 0, Withdrawn: 0}, *b)
+
+			err = c.Withdraw(ctx, "2377225624", 10)
+			var apiErr *Error
+			require.ErrorAs(t, err, &apiErr)
+			assert.Equal(t, http.StatusPaymentRequired, apiErr.StatusCode)
+			assert.ErrorIs(t, err, ErrInsufficientFunds)
+			assert.NotEmpty(t, apiErr.RequestID)
+
+			ws, err := c.Withdrawals(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, ws)
+
+			relogged := New(srv.URL)
+			require.NoError(t, relogged.Login(ctx, "user", "pass"))
+			page, err = New(srv.URL, WithToken(relogged.Token())).ListOrders(ctx, nil)
+			require.NoError(t, err)
+			assert.Len(t, page.Orders, 1)
+		})
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	ctx := context.Background()
+	var failures int32 = 2
+	srv := newServer(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/user/register" && atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+	require.NoError(t, c.Register(ctx, "user", "pass"))
+
+	_, err := c.Balance(ctx)
+	assert.NoError(t, err)
+
+	atomic.StoreInt32(&failures, 1)
+	err = c.Withdraw(ctx, "2377225624", 10)
+	assert.ErrorIs(t, err, ErrInternal, "withdraw must not be repeated")
+
+	atomic.StoreInt32(&failures, 1)
+	assert.ErrorIs(t, c.Login(ctx, "user", "pass"), ErrInternal, "login must not be repeated")
+
+	atomic.StoreInt32(&failures, 5)
+	_, err = c.Balance(ctx)
+	var apiErr *Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+}
+
+// memDB keeps users and orders in memory, enough for the client calls
+type memDB struct {
+	mu     sync.Mutex
+	users  map[string]*models.User
+	orders []models.Order
+}
+
+func newMemDB() *memDB {
+	return &memDB{users: map[string]*models.User{}}
+}
+
+func (db *memDB) CreateNewUser(ctx context.Context, user *models.User, audit models.AuditEvent) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.users[user.Login]; ok {
+		return -1, errors.New("user already exists")
+	}
+	user.ID = int64(len(db.users) + 1)
+	u := *user
+	db.users[user.Login] = &u
+	return 1, nil
+}
+
+func (db *memDB) SelectPass(ctx context.Context, user *models.User) (*string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.users[user.Login]
+	if !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	user.ID = u.ID
+	pass := u.Password
+	return &pass, nil
+}
+
+func (db *memDB) SelectBalance(ctx context.Context, user int64) (*models.Balance, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	b := &models.Balance{}
+	for _, o := range db.orders {
+		if o.UserID == user && o.Status == "PROCESSED" {
+			b.Current += o.Amount
+			if o.Amount < 0 {
+				b.Withdrawn += o.Amount
+			}
+		}
+	}
+	return b, nil
+}
+
+func (db *memDB) InsertOrder(ctx context.Context, order models.Order, audit models.AuditEvent) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, o := range db.orders {
+		if o.ID == order.ID && o.UserID == order.UserID {
+			return storage.ErrOrderExists
+		} else if o.ID == order.ID {
+			return storage.ErrOrderConflict
+		}
+	}
+	if order.Status == "" {
+		order.Status = "NEW"
+	}
+	if order.Type == "" {
+		order.Type = "top_up"
+	}
+	order.Date = time.Now()
+	order.Seq = int64(len(db.orders) + 1)
+	db.orders = append(db.orders, order)
+	return nil
+}
+
+func (db *memDB) InsertOrders(ctx context.Context, orders []models.Order, audit models.AuditEvent) ([]error, error) {
+	errs := make([]error, len(orders))
+	for i, o := range orders {
+		errs[i] = db.InsertOrder(ctx, o, audit)
+	}
+	return errs, nil
+}
+
+func (db *memDB) SelectOrdersForUpdate(ctx context.Context, cfg *config.Config, in chan []models.Order, out chan models.Order) {
+}
+
+func (db *memDB) SelectAllOrders(ctx context.Context, user int64) ([]*models.Order, error) {
+	return db.SelectOrders(ctx, user, models.OrderFilter{Type: "top_up"})
+}
+
+func (db *memDB) SelectOrders(ctx context.Context, user int64, f models.OrderFilter) ([]*models.Order, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var res []*models.Order
+	for i := range db.orders {
+		o := db.orders[i]
+		if o.UserID == user && o.Type == f.Type && (f.After == nil || o.Seq > f.After.Seq) {
+			res = append(res, &o)
+		}
+		if f.Limit > 0 && len(res) == f.Limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+func (db *memDB) SelectOrder(ctx context.Context, number int64) (*models.Order, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, o := range db.orders {
+		if o.ID == number {
+			return &o, nil
+		}
+	}
+	return nil, storage.ErrOrderNotFound
+}
+
+func (db *memDB) SelectAllWithdrawals(ctx context.Context, user int64) (*[]models.Withdrawal, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var ws []models.Withdrawal
+	for _, o := range db.orders {
+		if o.UserID == user && o.Type == "withdraw" {
+			ws = append(ws, models.Withdrawal{ID: o.ID, Amount: o.Amount, Date: o.Date})
+		}
+	}
+	return &ws, nil
+}
+
+func (db *memDB) SelectOrderEvents(ctx context.Context, user int64, after int64) ([]models.OrderEvent, error) {
+	return nil, nil
+}
+
+func (db *memDB) CreateWebhook(ctx context.Context, w *models.Webhook) error {
+	return nil
+}
+
+func (db *memDB) SelectWebhooks(ctx context.Context, user int64) ([]models.Webhook, error) {
+	return nil, nil
+}
+
+func (db *memDB) DeleteWebhook(ctx context.Context, user int64, id int64) error {
+	return storage.ErrWebhookNotFound
+}
+
+func (db *memDB) SelectWebhookDeliveries(ctx context.Context, user int64, id int64) ([]models.WebhookDelivery, error) {
+	return nil, storage.ErrWebhookNotFound
+}
+
+func (db *memDB) ClaimWebhookMessages(ctx context.Context, limit int) ([]models.WebhookMessage, error) {
+	return nil, nil
+}
+
+func (db *memDB) RecordWebhookDelivery(ctx context.Context, d models.WebhookDelivery, delivered bool, retryAt time.Time) error {
+	return nil
+}
+
+func (db *memDB) EnqueueWebhooks(ctx context.Context, ev models.DomainEvent) error {
+	return nil
+}
+
+func (db *memDB) ProcessOutbox(ctx context.Context, limit int, publish func([]models.DomainEvent) []int64) (int, error) {
+	return 0, nil
+}
+
+func (db *memDB) SelectUserAccess(ctx context.Context, id int64) (string, bool, error) {
+	return models.RoleUser, false, nil
+}
+
+func (db *memDB) SearchUsers(ctx context.Context, query string, limit int) ([]models.UserInfo, error) {
+	return nil, nil
+}
+
+func (db *memDB) SelectUser(ctx context.Context, id int64) (*models.UserInfo, error) {
+	return nil, storage.ErrUserNotFound
+}
+
+func (db *memDB) SelectLedger(ctx context.Context, id int64) ([]models.LedgerEntry, error) {
+	return nil, nil
+}
+
+func (db *memDB) AdjustBalance(ctx context.Context, adj models.Adjustment, audit models.AuditEvent) error {
+	return storage.ErrUserNotFound
+}
+
+func (db *memDB) SetUserBlocked(ctx context.Context, id int64, blocked bool, audit models.AuditEvent) error {
+	return storage.ErrUserNotFound
+}
+
+func (db *memDB) SetUserRole(ctx context.Context, id int64, role string, audit models.AuditEvent) error {
+	return storage.ErrUserNotFound
+}
+
+func (db *memDB) InsertAudit(ctx context.Context, ev models.AuditEvent) error {
+	return nil
+}
+
+func (db *memDB) ExportAudit(ctx context.Context, f models.AuditFilter, fn func(models.AuditEvent) error) error {
+	return nil
+}
+
+func (db *memDB) RequeueOrder(ctx context.Context, number int64, audit models.AuditEvent) error {
+	return storage.ErrOrderNotFound
+}
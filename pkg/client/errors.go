@@ -0,0 +1,71 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error is a problem details response of the API. Compare it with errors.Is against
+// the Err* values, they match by code.
+type Error struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	RequestID  string `json:"request_id"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("gophermart: %d %s", e.StatusCode, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// Is reports whether target is an *Error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Errors which can be returned by the API
+var (
+	ErrInvalidRequest     = &Error{Code: "invalid_request"}
+	ErrUnauthorized       = &Error{Code: "unauthorized"}
+	ErrWrongCredentials   = &Error{Code: "wrong_credentials"}
+	ErrLoginTaken         = &Error{Code: "login_taken"}
+	ErrAccountBlocked     = &Error{Code: "account_blocked"}
+	ErrTooManyAttempts    = &Error{Code: "too_many_attempts"}
+	ErrInvalidOrderNumber = &Error{Code: "invalid_order_number"}
+	ErrOrderConflict      = &Error{Code: "order_conflict"}
+	ErrOrderNumberUsed    = &Error{Code: "order_number_used"}
+	ErrInsufficientFunds  = &Error{Code: "insufficient_funds"}
+	ErrTooManyRequests    = &Error{Code: "too_many_requests"}
+	ErrInternal           = &Error{Code: "internal_error"}
+)
+
+// decodeError builds Error from the response, responses which are not problem details
+// get code by their status
+func decodeError(resp *http.Response, body []byte) error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e = &Error{Title: http.StatusText(resp.StatusCode), Detail: string(body)}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			e.Code = ErrUnauthorized.Code
+		case resp.StatusCode == http.StatusTooManyRequests:
+			e.Code = ErrTooManyRequests.Code
+		case resp.StatusCode >= 500:
+			e.Code = ErrInternal.Code
+		default:
+			e.Code = ErrInvalidRequest.Code
+		}
+	}
+	e.StatusCode = resp.StatusCode
+	return e
+}
@@ -0,0 +1,52 @@
+package client
+
+import "time"
+
+// Order statuses
+const (
+	StatusNew        = "NEW"
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+)
+
+// Order is an order uploaded by the user
+type Order struct {
+	Number     string    `json:"number"`
+	Status     string    `json:"status"`
+	Accrual    float64   `json:"accrual"`
+	UploadedAt time.Time `json:"uploaded_at"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// Balance is the current amount of bonuses and the amount spent during the whole time
+type Balance struct {
+	Current   float64 `json:"current"`
+	Withdrawn float64 `json:"withdrawn"`
+}
+
+// Withdrawal is a payment for an order with bonuses
+type Withdrawal struct {
+	Order       string    `json:"order"`
+	Sum         float64   `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// ListOrdersParams filters and paginates the orders list. Zero value lists all uploaded orders at once.
+type ListOrdersParams struct {
+	Limit    int
+	Cursor   string
+	Statuses []string
+	// Type is top_up by default, withdraw lists orders paid with bonuses
+	Type string
+	From time.Time
+	To   time.Time
+	Desc bool
+}
+
+// OrdersPage is a page of orders, NextCursor is empty on the last one
+type OrdersPage struct {
+	Orders     []Order
+	NextCursor string
+}